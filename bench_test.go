@@ -0,0 +1,146 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// mapperFanOut emits values ints spread over reduceKeys reduce keys, prefixed
+// with the map key when unique is set.
+type mapperFanOut struct {
+	values     int
+	reduceKeys int
+	unique     bool
+}
+
+func (m *mapperFanOut) Map(io MapIO) error {
+	prefix := ""
+	if m.unique {
+		prefix = io.MapKey() + "."
+	}
+	for i := 0; i < m.values; i++ {
+		io.Emit(prefix+strconv.Itoa(i%m.reduceKeys), i)
+	}
+	return nil
+}
+
+func benchKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	return keys
+}
+
+// runBench runs the map reduce b.N times and reports the throughput in
+// emitted values per second.
+func runBench(b *testing.B, keys []string, cache *MappingCache, mapper *mapperFanOut, reducer Reducer, opts *Options) {
+	b.ReportAllocs()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		out := make(chan KeyValue)
+		go MapReduceWithOptions(GeneratorFromSlice(keys), out, nil, cache, nil, mapper, reducer, opts)
+		for range out {
+		}
+	}
+	b.ReportMetric(float64(b.N*len(keys)*mapper.values)/time.Since(start).Seconds(), "values/s")
+}
+
+// BenchmarkMapReduceFanOut measures a few mappers emitting a lot of values to
+// a few reduce keys, as the buffering knobs are meant for.
+func BenchmarkMapReduceFanOut(b *testing.B) {
+	data := []struct {
+		name string
+		opts *Options
+	}{
+		{"default", nil},
+		{"OrderedValues", &Options{OrderedValues: true}},
+		{"FeederWorkers", &Options{FeederWorkers: 4}},
+		{"MaxBufferedValues", &Options{MaxBufferedValues: 100}},
+		{"AccumulatorBuffer", &Options{AccumulatorBuffer: 100}},
+		{"Combiner", &Options{Combiner: &CombineSum{}}},
+	}
+	for _, d := range data {
+		b.Run(d.name, func(b *testing.B) {
+			runBench(b, benchKeys(10), nil, &mapperFanOut{values: 1000, reduceKeys: 10}, &ReduceSum{}, d.opts)
+		})
+	}
+}
+
+// BenchmarkMapReduceManyReduceKeys measures a lot of reduce keys with a few
+// values each, i.e. a lot of reducer goroutines.
+func BenchmarkMapReduceManyReduceKeys(b *testing.B) {
+	data := []struct {
+		name string
+		opts *Options
+	}{
+		{"default", nil},
+		{"MaxReducers", &Options{MaxReducers: 8}},
+		{"SerialReduce", &Options{SerialReduce: true}},
+		{"MaxMappers", &Options{MaxMappers: 4}},
+	}
+	for _, d := range data {
+		b.Run(d.name, func(b *testing.B) {
+			runBench(b, benchKeys(100), nil, &mapperFanOut{values: 100, reduceKeys: 50, unique: true}, &ReduceSum{}, d.opts)
+		})
+	}
+}
+
+// BenchmarkMapReduceCacheHit measures replaying all the values from the
+// cache, without running any mapper.
+func BenchmarkMapReduceCacheHit(b *testing.B) {
+	keys := benchKeys(100)
+	mapper := &mapperFanOut{values: 100, reduceKeys: 10}
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	out := make(chan KeyValue)
+	go MapReduce(GeneratorFromSlice(keys), out, nil, cache, nil, mapper, &ReduceSum{})
+	for range out {
+	}
+	b.ResetTimer()
+	runBench(b, keys, cache, mapper, &ReduceSum{}, nil)
+}
+
+// BenchmarkMappingCacheLoad measures loading a saved cache with a lot of map
+// keys.
+func BenchmarkMappingCacheLoad(b *testing.B) {
+	cache := &MappingCache{}
+	cache.SetValueType("")
+	kvs := make([]KeyValue, 100)
+	for i := range kvs {
+		kvs[i] = KeyValue{strconv.Itoa(i), strconv.Itoa(i * i)}
+	}
+	for _, k := range benchKeys(1000) {
+		if err := cache.Put(k, kvs); err != nil {
+			b.Fatal(err)
+		}
+	}
+	buf := bytes.Buffer{}
+	if err := cache.Save(&buf); err != nil {
+		b.Fatal(err)
+	}
+	data := []struct {
+		name string
+		load func(c *MappingCache, r *bytes.Reader) error
+	}{
+		{"Load", func(c *MappingCache, r *bytes.Reader) error { return c.Load(r) }},
+		{"LoadParallel", func(c *MappingCache, r *bytes.Reader) error { return c.LoadParallel(r) }},
+	}
+	for _, d := range data {
+		b.Run(d.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(buf.Len()))
+			for i := 0; i < b.N; i++ {
+				if err := d.load(&MappingCache{}, bytes.NewReader(buf.Bytes())); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
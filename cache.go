@@ -0,0 +1,627 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MappingCache caches all the data. It is serializable, either directly or
+// via Save and Load. Only Save and Load support a CacheStore set via SetStore.
+type MappingCache struct {
+	lock      sync.Mutex
+	valueType reflect.Type            // Do not export so it is not serialized; reflect.Type can't be serialized.
+	types     map[string]reflect.Type // Registered types, keyed by typeTag().
+	lenient   bool                    // Set via SetStrictType(false).
+	Version   string                  // Set via SetVersion.
+	Data      map[string]*cacheValues // Used when no CacheStore is set.
+	store     CacheStore              // Set via SetStore.
+	dirty     map[string]bool         // Map keys being mapped by a running MapReduce.
+	lru       *lruStore               // Set via SetMaxBytes.
+	Accessed  map[string]time.Time    // Last cache hit of each map key, see AccessTimes.
+
+	logLock sync.Mutex
+	log     *os.File // Set by OpenLog.
+}
+
+// SetValueType must be called before usage, unless RegisterType is used.
+//
+// It sets the type of value as the only type that can be cached.
+func (c *MappingCache) SetValueType(value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.valueType = reflect.TypeOf(value)
+	c.types = map[string]reflect.Type{typeTag(c.valueType): c.valueType}
+}
+
+// RegisterType adds the type of value to the types that can be cached.
+//
+// It can be called multiple times so a mapper can emit values of different
+// types. Each cached value is tagged with its type so it is decoded back to the
+// same type. Types implementing gob.GobEncoder and gob.GobDecoder are
+// supported, with either value or pointer receivers.
+func (c *MappingCache) RegisterType(value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	t := reflect.TypeOf(value)
+	if c.valueType == nil {
+		c.valueType = t
+	}
+	if c.types == nil {
+		c.types = map[string]reflect.Type{}
+	}
+	c.types[typeTag(t)] = t
+}
+
+// RegisterGobType registers the concrete type of value with gob.Register.
+//
+// It is needed when the cached values hold interface fields, e.g. a
+// []interface{} or a struct with an error field: gob can only encode the
+// concrete types stored in an interface once they are registered. Unlike
+// RegisterType, the registration is global to the process.
+func (c *MappingCache) RegisterGobType(value interface{}) {
+	gob.Register(value)
+}
+
+// Put stores kvs as the cached values for mapKey, exactly as if the mapper
+// had emitted them, replacing any previous entry. The mapper will then be
+// skipped for mapKey.
+//
+// It is meant to seed the cache with authoritative data from another source.
+func (c *MappingCache) Put(mapKey string, kvs []KeyValue) error {
+	items := make([]CacheItem, 0, len(kvs))
+	for _, kv := range kvs {
+		if err := c.checkType(reflect.TypeOf(kv.Value)); err != nil {
+			return err
+		}
+		item, err := c.encode(mapKey, kv)
+		if err != nil {
+			return err
+		}
+		items = append(items, item)
+	}
+	c.lock.Lock()
+	err := c.backend().Put(mapKey, items)
+	if err == nil {
+		delete(c.dirty, mapKey)
+	}
+	c.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return c.appendLog(mapKey)
+}
+
+// SetStrictType sets whether the types of the emitted values are checked
+// against the types registered with SetValueType and RegisterType. It is
+// strict by default.
+//
+// When not strict, values of any type are cached as-is. A cached value whose
+// type is not registered at lookup time fails to decode and the map key is
+// then treated as a cache miss.
+func (c *MappingCache) SetStrictType(strict bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lenient = !strict
+}
+
+// Reset drops all the cached entries. The registered types and the version are
+// kept.
+func (c *MappingCache) Reset() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	s := c.backend()
+	keys, err := s.Keys()
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := s.Delete(k); err != nil {
+			return err
+		}
+	}
+	c.dirty = nil
+	c.Accessed = nil
+	return nil
+}
+
+// Compact removes the entries of the map keys not in liveKeys and returns the
+// number of entries removed. Entries being mapped by a running MapReduce are
+// kept. With Options.CacheKeyFunc, liveKeys are the cache keys.
+func (c *MappingCache) Compact(liveKeys []string) (int, error) {
+	live := make(map[string]bool, len(liveKeys))
+	for _, k := range liveKeys {
+		live[k] = true
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	b := c.backend()
+	keys, err := b.Keys()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, k := range keys {
+		if !live[k] && !c.dirty[k] {
+			if err := b.Delete(k); err != nil {
+				return removed, err
+			}
+			delete(c.Accessed, k)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// ClearDirty marks every entry as clean.
+//
+// An entry is dirty while its map key is being mapped: it is marked dirty by
+// the first value emitted, dirty entries are neither used as cache hits nor
+// saved, and a MapReduce marks all entries clean once all its mappers
+// completed. ClearDirty is only needed to recover the partial entries of a
+// run that did not complete; they are then used as-is by the next runs.
+//
+// With SetMaxBytes, the entries no longer dirty are evicted as needed and the
+// error of the CacheStore, if any, is returned.
+func (c *MappingCache) ClearDirty() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.dirty = nil
+	if c.lru != nil {
+		return c.lru.evict()
+	}
+	return nil
+}
+
+// CacheStats is the size of a MappingCache, as returned by
+// MappingCache.Stats().
+type CacheStats struct {
+	Entries int   // Number of map keys cached.
+	Bytes   int64 // Total size of the serialized values.
+	Dirty   int   // Number of map keys being mapped in a running MapReduce.
+}
+
+// Stats returns the current size of the cache.
+func (c *MappingCache) Stats() (CacheStats, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	b := c.backend()
+	keys, err := b.Keys()
+	if err != nil {
+		return CacheStats{}, err
+	}
+	s := CacheStats{Entries: len(keys), Dirty: len(c.dirty)}
+	for _, k := range keys {
+		items, _, err := b.Get(k)
+		if err != nil {
+			return CacheStats{}, err
+		}
+		for _, i := range items {
+			s.Bytes += int64(len(i.Value))
+		}
+	}
+	return s, nil
+}
+
+// AccessTimes returns the time of the last cache hit of each cached map key,
+// as read from Options.Clock, or the zero time for the map keys never hit
+// since they were cached. The times are saved and loaded along with the
+// entries, so the keys that haven't been hit in a while, e.g. because they are
+// no longer generated, can be pruned with Compact.
+//
+// Entries being mapped by a running MapReduce are skipped.
+func (c *MappingCache) AccessTimes() (map[string]time.Time, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	keys, err := c.backend().Keys()
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]time.Time{}
+	for _, k := range keys {
+		if !c.dirty[k] {
+			out[k] = c.Accessed[k]
+		}
+	}
+	return out, nil
+}
+
+// Walk calls fn for each cached item, in map key order, without decoding the
+// values. Iteration stops at the first error returned by fn, which is then
+// returned.
+//
+// The cache is locked during the whole iteration so fn must not call into the
+// cache.
+func (c *MappingCache) Walk(fn func(mapKey, reduceKey string) error) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	b := c.backend()
+	keys, err := b.Keys()
+	if err != nil {
+		return err
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		items, _, err := b.Get(k)
+		if err != nil {
+			return err
+		}
+		for _, i := range items {
+			if err := fn(k, i.Key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type cacheValues struct {
+	Items []CacheItem
+}
+
+// CacheItem is a single value emitted by a mapper, as stored in the cache.
+type CacheItem struct {
+	Key      string
+	Type     string // typeTag() of the object. Empty for entries cached before type tagging; valueType is then used.
+	Value    []byte // GobEncoded object.
+	Checksum uint32 // CRC32 (IEEE) of Value.
+	// False for entries cached before checksumming; Checksum is then not
+	// verified.
+	HasChecksum bool
+}
+
+// verify returns an error if the item is corrupted.
+func (s *CacheItem) verify() error {
+	if s.HasChecksum && crc32.ChecksumIEEE(s.Value) != s.Checksum {
+		return errors.New("checksum mismatch")
+	}
+	return nil
+}
+
+// verifyItems returns an error if any item is corrupted.
+func verifyItems(items []CacheItem) error {
+	for i := range items {
+		if err := items[i].verify(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// typeTag returns a string that uniquely identifies t.
+func typeTag(t reflect.Type) string {
+	if t.Name() != "" && t.PkgPath() != "" {
+		return t.PkgPath() + "." + t.Name()
+	}
+	return t.String()
+}
+
+// nilTypeTag is the type of a nil interface{} value.
+const nilTypeTag = "<nil>"
+
+// checkType returns an error if t was not registered, unless the cache is not
+// strict. A nil value is always accepted.
+func (c *MappingCache) checkType(t reflect.Type) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.checkTypeLocked(t)
+}
+
+// checkTypeLocked is checkType with c.lock held.
+func (c *MappingCache) checkTypeLocked(t reflect.Type) error {
+	if t == nil || c.lenient || c.types[typeTag(t)] == t {
+		return nil
+	}
+	if len(c.types) <= 1 {
+		return &TypeMismatchError{c.valueType, t}
+	}
+	return fmt.Errorf("type %v is not registered", t)
+}
+
+// decodeType returns the type to decode item into.
+func (c *MappingCache) decodeType(item *CacheItem) (reflect.Type, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if item.Type == "" {
+		return c.valueType, nil
+	}
+	if t := c.types[item.Type]; t != nil {
+		return t, nil
+	}
+	return nil, fmt.Errorf("type %s is not registered", item.Type)
+}
+
+// GetKey returns the cached values for mapKey, as they would be replayed by
+// MapReduce. found is false if mapKey isn't cached or is being mapped by a
+// running MapReduce.
+//
+// An error is returned if a value is corrupted or fails to decode. Unlike in
+// MapReduce, the entry is left in the cache.
+func (c *MappingCache) GetKey(mapKey string) ([]KeyValue, bool, error) {
+	return c.lookup(mapKey, nil)
+}
+
+// GetKeyInto is GetKey that decodes each value into the pointer returned by
+// dst instead of a newly allocated value, so a caller going over a lot of
+// entries can reuse its buffers. dst is called once per value and must return
+// a non-nil pointer to the type of the value, e.g. *[]int when the value type
+// is []int. The Value of each KeyValue returned is that pointer, except for
+// the nil values which are returned as is without calling dst.
+//
+// gob leaves untouched the fields whose encoded value is zero, so the value
+// pointed to must be reset before it is reused.
+//
+// It returns nil if mapKey isn't cached or is being mapped by a running
+// MapReduce.
+func (c *MappingCache) GetKeyInto(mapKey string, dst func() interface{}) ([]KeyValue, error) {
+	out, _, err := c.lookup(mapKey, dst)
+	return out, err
+}
+
+// Explain returns a human readable reason why mapKey would be a cache hit or
+// a cache miss in the next MapReduce. It is a debugging aid for unexpected
+// cache misses. With Options.CacheKeyFunc, mapKey is the cache key.
+//
+// It doesn't count as a cache hit for SetMaxBytes or AccessTimes.
+func (c *MappingCache) Explain(mapKey string) string {
+	c.lock.Lock()
+	items, ok, err := c.backend().Get(mapKey)
+	dirty := c.dirty[mapKey]
+	c.lock.Unlock()
+	if err != nil {
+		return fmt.Sprintf("miss: the store failed: %s", err)
+	}
+	if !ok {
+		return "miss: not cached"
+	}
+	if dirty {
+		return "miss: being mapped by a running MapReduce"
+	}
+	for i := range items {
+		if _, err := c.decode(&items[i]); err != nil {
+			return fmt.Sprintf("miss: item %d (reduce key %s) fails to decode and the entry will be dropped: %s", i, items[i].Key, err)
+		}
+	}
+	if len(items) == 0 {
+		return "hit: no values, the mapper emitted nothing"
+	}
+	return fmt.Sprintf("hit: %d values", len(items))
+}
+
+// get returns the cached values for key, or nil on a cache miss. A cache hit
+// is recorded in Accessed at clock.Now().
+//
+// If any value is corrupted or fails to decode, the error is sent to onError and the whole key
+// is treated as a miss. Its entry is dropped so the mapper re-populates it,
+// instead of emitting a partial result.
+func (c *MappingCache) get(key string, clock Clock, onError func(error)) []KeyValue {
+	out, ok, err := c.lookup(key, nil)
+	if ok {
+		now := clock.Now()
+		c.lock.Lock()
+		if c.Accessed == nil {
+			c.Accessed = map[string]time.Time{}
+		}
+		c.Accessed[key] = now
+		c.lock.Unlock()
+	}
+	if err != nil {
+		onError(err)
+		c.lock.Lock()
+		// Don't drop the entry if a mapper is already re-populating it.
+		if !c.dirty[key] {
+			if err := c.backend().Delete(key); err != nil {
+				onError(err)
+			}
+		}
+		c.lock.Unlock()
+		return nil
+	}
+	return out
+}
+
+// lookup decodes the cached values for key, into the pointers returned by dst
+// if set.
+func (c *MappingCache) lookup(key string, dst func() interface{}) ([]KeyValue, bool, error) {
+	c.lock.Lock()
+	items, ok, err := c.backend().Get(key)
+	dirty := c.dirty[key]
+	if ok && !dirty && c.lru != nil {
+		c.lru.touch(key)
+	}
+	c.lock.Unlock()
+
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read from cache for key %s: %s", key, err)
+	}
+	if !ok || dirty {
+		return nil, false, nil
+	}
+	out := make([]KeyValue, 0, len(items))
+	for i := range items {
+		kv, err := c.decodeInto(&items[i], dst)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to decode from cache for key %s: %s", key, err)
+		}
+		out = append(out, kv)
+	}
+	return out, true, nil
+}
+
+// decode decodes a single cached item.
+func (c *MappingCache) decode(item *CacheItem) (KeyValue, error) {
+	return c.decodeInto(item, nil)
+}
+
+// decodeInto decodes a single cached item into the pointer returned by dst,
+// or into a new value if dst is nil.
+func (c *MappingCache) decodeInto(item *CacheItem, dst func() interface{}) (KeyValue, error) {
+	if err := item.verify(); err != nil {
+		return KeyValue{}, err
+	}
+	if item.Type == nilTypeTag {
+		return KeyValue{item.Key, nil}, nil
+	}
+	t, err := c.decodeType(item)
+	if err != nil {
+		return KeyValue{}, err
+	}
+	if len(item.Value) == 0 {
+		// A nil pointer; gob never produces an empty encoding.
+		return KeyValue{item.Key, reflect.Zero(t).Interface()}, nil
+	}
+	if dst != nil {
+		ptr := dst()
+		obj := reflect.ValueOf(ptr)
+		if obj.Kind() != reflect.Ptr || obj.IsNil() || obj.Elem().Type() != t {
+			return KeyValue{}, fmt.Errorf("dst returned %T, expected a non-nil *%v", ptr, t)
+		}
+		if err := gob.NewDecoder(bytes.NewBuffer(item.Value)).DecodeValue(obj); err != nil {
+			return KeyValue{}, err
+		}
+		return KeyValue{item.Key, ptr}, nil
+	}
+	// Creates a pointer to the type.
+	obj := reflect.New(t)
+	if err := gob.NewDecoder(bytes.NewBuffer(item.Value)).DecodeValue(obj); err != nil {
+		return KeyValue{}, err
+	}
+	// reflect.New() returns a *pointer* to type t, so deference the pointer
+	// here.
+	return KeyValue{item.Key, obj.Elem().Interface()}, nil
+}
+
+// encode serializes kv, emitted by the mapper for mapKey.
+func (c *MappingCache) encode(mapKey string, kv KeyValue) (CacheItem, error) {
+	if kv.Value == nil {
+		return CacheItem{kv.Key, nilTypeTag, nil, crc32.ChecksumIEEE(nil), true}, nil
+	}
+	b, err := gobEncode(kv.Value)
+	if err != nil {
+		if strings.Contains(err.Error(), "type not registered for interface") {
+			return CacheItem{}, fmt.Errorf("failed to encode to cache key %s: %s; register the type with MappingCache.RegisterGobType", mapKey, err)
+		}
+		return CacheItem{}, fmt.Errorf("failed to encode to cache key %s: %s", mapKey, err)
+	}
+	return CacheItem{kv.Key, typeTag(reflect.TypeOf(kv.Value)), b, crc32.ChecksumIEEE(b), true}, nil
+}
+
+// gobEncode serializes value, which must not be nil.
+//
+// gob can't encode nil pointers so they are encoded as an empty slice.
+func gobEncode(value interface{}) ([]byte, error) {
+	v := reflect.ValueOf(value)
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		return nil, nil
+	}
+	// Encode a pointer to a copy of a non-pointer value so it is addressable,
+	// which gob needs when GobEncode has a pointer receiver. gob flattens
+	// pointers so the encoding is the same.
+	if v.Kind() != reflect.Ptr {
+		ptr := reflect.New(v.Type())
+		ptr.Elem().Set(v)
+		value = ptr.Interface()
+	}
+	buf := bytes.Buffer{}
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// appendOutput appends kv to the entry of kv.Key, for Options.OutputCache. If
+// replace is set, the existing entry is discarded first.
+func (c *MappingCache) appendOutput(kv KeyValue, replace bool) error {
+	if err := c.checkType(reflect.TypeOf(kv.Value)); err != nil {
+		return err
+	}
+	item, err := c.encode(kv.Key, kv)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	b := c.backend()
+	var items []CacheItem
+	if !replace {
+		items, _, err = b.Get(kv.Key)
+	}
+	if err == nil {
+		err = b.Put(kv.Key, append(items, item))
+	}
+	c.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return c.appendLog(kv.Key)
+}
+
+// complete records that the mapper for mapKey succeeded. It creates an empty
+// entry if nothing was emitted, so the key is still a cache hit next time.
+func (c *MappingCache) complete(mapKey string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	b := c.backend()
+	_, ok, err := b.Get(mapKey)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return b.Put(mapKey, []CacheItem{})
+	}
+	return nil
+}
+
+// drop removes the values of mapKey after its mapper failed, so the partial
+// values emitted before the failure are not used as a cache hit.
+func (c *MappingCache) drop(mapKey string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	// Keep the entry dirty if it can't be deleted so it is not used.
+	if err := c.backend().Delete(mapKey); err != nil {
+		return err
+	}
+	delete(c.dirty, mapKey)
+	delete(c.Accessed, mapKey)
+	return nil
+}
+
+// add checks the types of the values of kvs like checkType and appends items,
+// their encoding, to the values of mapKey, with a single lock acquisition. It
+// returns the errors of the values whose type was rejected and the error of
+// the write. The items are appended even if some types were rejected.
+func (c *MappingCache) add(mapKey string, kvs []KeyValue, items []CacheItem) ([]error, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var typeErrs []error
+	for _, kv := range kvs {
+		if err := c.checkTypeLocked(reflect.TypeOf(kv.Value)); err != nil {
+			typeErrs = append(typeErrs, err)
+		}
+	}
+	if len(items) == 0 {
+		return typeErrs, nil
+	}
+	// Mark the entry dirty first so it is not evicted while being mapped.
+	if c.dirty == nil {
+		c.dirty = map[string]bool{}
+	}
+	c.dirty[mapKey] = true
+	b := c.backend()
+	existing, _, err := b.Get(mapKey)
+	if err != nil {
+		return typeErrs, err
+	}
+	return typeErrs, b.Put(mapKey, append(existing, items...))
+}
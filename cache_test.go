@@ -0,0 +1,662 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maruel/ut"
+)
+
+type point struct {
+	X, Y int
+}
+
+type mapperMixed struct {
+	t *testing.T
+}
+
+func (m *mapperMixed) Map(io MapIO) error {
+	if m.t != nil {
+		m.t.Fatal("This wasn't expected")
+	}
+	io.Emit("int", 1)
+	io.Emit("point", point{2, 3})
+	return nil
+}
+
+func collectMap(out <-chan KeyValue) map[string]interface{} {
+	actual := map[string]interface{}{}
+	for i := range out {
+		actual[i.Key] = i.Value
+	}
+	return actual
+}
+
+func TestMappingCacheRegisterType(t *testing.T) {
+	cache := &MappingCache{}
+	cache.RegisterType(0)
+	cache.RegisterType(point{})
+	expected := map[string]interface{}{"int": 1, "point": point{2, 3}}
+
+	errChan := make(chan error, 1)
+	out := make(chan KeyValue, 2)
+	MapReduce(GeneratorFromSlice([]string{"A"}), out, errChan, cache, nil, &mapperMixed{}, &ReducePassThrough{})
+	ut.AssertEqual(t, expected, collectMap(out))
+
+	// Cache hit, each value is decoded back to its own type.
+	perf := &PerfStats{}
+	out = make(chan KeyValue, 2)
+	MapReduce(GeneratorFromSlice([]string{"A"}), out, errChan, cache, perf, &mapperMixed{t: t}, &ReducePassThrough{})
+	ut.AssertEqual(t, expected, collectMap(out))
+	ut.AssertEqual(t, 1, perf.CacheHits())
+	ut.AssertEqual(t, 0, len(errChan))
+}
+
+func TestMappingCacheRegisterTypeMissing(t *testing.T) {
+	cache := &MappingCache{}
+	cache.RegisterType(0)
+	cache.RegisterType("")
+	errChan := make(chan error, 2)
+	out := make(chan KeyValue, 2)
+	MapReduce(GeneratorFromSlice([]string{"A"}), out, errChan, cache, nil, &mapperMixed{}, &ReducePassThrough{})
+	ut.AssertEqual(t, "failed to map A: type mapreduce.point is not registered", (<-errChan).Error())
+
+	// The partial result is not cached so the map key is mapped again.
+	ut.AssertEqual(t, []string{}, cachedKeys(cache))
+	perf := &PerfStats{}
+	out = make(chan KeyValue, 2)
+	MapReduce(GeneratorFromSlice([]string{"A"}), out, errChan, cache, perf, &mapperMixed{}, &ReducePassThrough{})
+	ut.AssertEqual(t, 1, perf.CacheMisses())
+	ut.AssertEqual(t, 2, len(Collect(out)))
+}
+
+func TestMappingCacheStats(t *testing.T) {
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	ut.AssertEqual(t, CacheStats{}, cacheStats(t, cache))
+
+	out := make(chan KeyValue, 2)
+	MapReduce(GeneratorFromSlice([]string{"A", "B"}), out, make(chan error), cache, nil, &mapperImpl{}, &ReducePassThrough{})
+	s := cacheStats(t, cache)
+	ut.AssertEqual(t, 2, s.Entries)
+	ut.AssertEqual(t, 0, s.Dirty)
+	ut.AssertEqual(t, int64(len(cache.Data["A"].Items[0].Value)*2), s.Bytes)
+
+	cache.dirty = map[string]bool{"A": true}
+	ut.AssertEqual(t, 1, cacheStats(t, cache).Dirty)
+}
+
+func TestMappingCacheWalk(t *testing.T) {
+	cache := &MappingCache{}
+	cache.RegisterType(0)
+	cache.RegisterType(point{})
+	MapReduce(GeneratorFromSlice([]string{"B", "A"}), make(chan KeyValue, 4), nil, cache, nil, &mapperMixed{}, &ReducePassThrough{})
+
+	actual := []string{}
+	err := cache.Walk(func(mapKey, reduceKey string) error {
+		actual = append(actual, mapKey+"/"+reduceKey)
+		return nil
+	})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{"A/int", "A/point", "B/int", "B/point"}, actual)
+
+	stop := errors.New("stop")
+	count := 0
+	err = cache.Walk(func(mapKey, reduceKey string) error {
+		count++
+		return stop
+	})
+	ut.AssertEqual(t, stop, err)
+	ut.AssertEqual(t, 1, count)
+}
+
+func TestMappingCacheDecodeErrorIsMiss(t *testing.T) {
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	mapper := &mapperMulti{}
+	MapReduce(GeneratorFromSlice([]string{"A"}), make(chan KeyValue, 4), nil, cache, nil, mapper, &ReducePassThrough{})
+	ut.AssertEqual(t, 4, len(cache.Data["A"].Items))
+
+	// Corrupt one of the values.
+	cache.Data["A"].Items[2].Value = []byte("bad")
+	errChan := make(chan error, 1)
+	perf := &PerfStats{}
+	out := make(chan KeyValue)
+	go MapReduce(GeneratorFromSlice([]string{"A"}), out, errChan, cache, perf, mapper, &reducerTotal{})
+	// The key was fully re-mapped, the other values were not emitted from the
+	// cache.
+	ut.AssertEqual(t, map[string]interface{}{"A": 6, "all": 10}, collectMap(out))
+	ut.AssertEqual(t, true, strings.HasPrefix((<-errChan).Error(), "failed to decode from cache for key A: "))
+	ut.AssertEqual(t, 0, perf.CacheHits())
+	ut.AssertEqual(t, 1, perf.CacheMisses())
+
+	// The entry healed.
+	perf = &PerfStats{}
+	MapReduce(GeneratorFromSlice([]string{"A"}), make(chan KeyValue, 4), errChan, cache, perf, &mapperImpl{t: t}, &ReducePassThrough{})
+	ut.AssertEqual(t, 1, perf.CacheHits())
+	ut.AssertEqual(t, 4, len(cache.Data["A"].Items))
+}
+
+func TestMappingCachePut(t *testing.T) {
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	ut.AssertEqual(t, nil, cache.Put("A", []KeyValue{{"x", 1}, {"y", 2}}))
+	ut.AssertEqual(t, "expected type int, got string", cache.Put("B", []KeyValue{{"x", "bad"}}).Error())
+
+	perf := &PerfStats{}
+	out := make(chan KeyValue, 2)
+	MapReduce(GeneratorFromSlice([]string{"A"}), out, nil, cache, perf, &mapperImpl{t: t}, &ReducePassThrough{})
+	ut.AssertEqual(t, map[string]interface{}{"x": 1, "y": 2}, collectMap(out))
+	ut.AssertEqual(t, 1, perf.CacheHits())
+	ut.AssertEqual(t, 1, len(cache.Data))
+}
+
+func TestMappingCacheNotStrict(t *testing.T) {
+	cache := &MappingCache{}
+	cache.SetStrictType(false)
+	errChan := make(chan error, 1)
+	out := make(chan KeyValue, 2)
+	MapReduce(GeneratorFromSlice([]string{"A"}), out, errChan, cache, nil, &mapperMixed{}, &ReducePassThrough{})
+	ut.AssertEqual(t, 0, len(errChan))
+	ut.AssertEqual(t, 2, len(cache.Data["A"].Items))
+
+	// The types are needed to decode.
+	cache.RegisterType(0)
+	cache.RegisterType(point{})
+	perf := &PerfStats{}
+	out = make(chan KeyValue, 2)
+	MapReduce(GeneratorFromSlice([]string{"A"}), out, errChan, cache, perf, &mapperMixed{t: t}, &ReducePassThrough{})
+	ut.AssertEqual(t, map[string]interface{}{"int": 1, "point": point{2, 3}}, collectMap(out))
+	ut.AssertEqual(t, 1, perf.CacheHits())
+	ut.AssertEqual(t, 0, len(errChan))
+}
+
+func TestMappingCacheNotStrictUnregistered(t *testing.T) {
+	cache := &MappingCache{}
+	cache.SetStrictType(false)
+	cache.RegisterType(0)
+	MapReduce(GeneratorFromSlice([]string{"A"}), make(chan KeyValue, 2), nil, cache, nil, &mapperMixed{}, &ReducePassThrough{})
+
+	// point is not registered, so it is a cache miss.
+	errChan := make(chan error, 1)
+	perf := &PerfStats{}
+	MapReduce(GeneratorFromSlice([]string{"A"}), make(chan KeyValue, 2), errChan, cache, perf, &mapperMixed{}, &ReducePassThrough{})
+	ut.AssertEqual(t, 1, perf.CacheMisses())
+	ut.AssertEqual(t, "failed to decode from cache for key A: type github.com/maruel/mapreduce.point is not registered", (<-errChan).Error())
+}
+
+// baselineCache is MappingCache as it was serialized before the values were
+// type tagged and checksummed.
+type baselineCache struct {
+	Data map[string]*baselineValues
+}
+
+type baselineValues struct {
+	Items []baselineItem
+}
+
+type baselineItem struct {
+	Key   string
+	Value []byte
+}
+
+func TestMappingCacheBaselineFormat(t *testing.T) {
+	value := bytes.Buffer{}
+	ut.AssertEqual(t, nil, gob.NewEncoder(&value).Encode(1))
+	old := baselineCache{map[string]*baselineValues{"A": {[]baselineItem{{"A.1", value.Bytes()}}}}}
+	buf := bytes.Buffer{}
+	ut.AssertEqual(t, nil, gob.NewEncoder(&buf).Encode(&old))
+
+	cache := &MappingCache{}
+	ut.AssertEqual(t, nil, gob.NewDecoder(&buf).Decode(cache))
+	cache.SetValueType(0)
+	ut.AssertEqual(t, "hit: 1 values", cache.Explain("A"))
+	kvs, found, err := cache.GetKey("A")
+	ut.AssertEqual(t, []KeyValue{{"A.1", 1}}, kvs)
+	ut.AssertEqual(t, true, found)
+	ut.AssertEqual(t, nil, err)
+
+	perf := &PerfStats{}
+	out := make(chan KeyValue, 1)
+	MapReduce(GeneratorFromSlice([]string{"A"}), out, nil, cache, perf, &mapperImpl{t: t}, &ReducePassThrough{})
+	ut.AssertEqual(t, 1, perf.CacheHits())
+	ut.AssertEqual(t, []KeyValue{{"A.1", 1}}, Collect(out))
+}
+
+func TestMappingCacheResetClearDirty(t *testing.T) {
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	ut.AssertEqual(t, nil, cache.Reset())
+	item, err := cache.encode("A", KeyValue{"a", 1})
+	ut.AssertEqual(t, nil, err)
+	cache.add("A", nil, []CacheItem{item})
+	ut.AssertEqual(t, CacheStats{Entries: 1, Bytes: int64(len(item.Value)), Dirty: 1}, cacheStats(t, cache))
+	ut.AssertEqual(t, []KeyValue(nil), cache.get("A", systemClock{}, func(error) {}))
+
+	ut.AssertEqual(t, nil, cache.ClearDirty())
+	ut.AssertEqual(t, CacheStats{Entries: 1, Bytes: int64(len(item.Value))}, cacheStats(t, cache))
+	ut.AssertEqual(t, []KeyValue{{"a", 1}}, cache.get("A", systemClock{}, func(error) {}))
+
+	ut.AssertEqual(t, nil, cache.Reset())
+	ut.AssertEqual(t, CacheStats{}, cacheStats(t, cache))
+}
+
+type mapperNil struct {
+	t *testing.T
+}
+
+func (m *mapperNil) Map(io MapIO) error {
+	if m.t != nil {
+		m.t.Fatal("This wasn't expected")
+	}
+	io.Emit("nil", nil)
+	io.Emit("ptr", (*point)(nil))
+	return nil
+}
+
+func TestMappingCacheNil(t *testing.T) {
+	cache := &MappingCache{}
+	cache.SetValueType(&point{})
+	errChan := make(chan error, 10)
+	expected := map[string]interface{}{"nil": nil, "ptr": (*point)(nil)}
+	out := make(chan KeyValue, 2)
+	MapReduce(GeneratorFromSlice([]string{"A"}), out, errChan, cache, nil, &mapperNil{}, &ReducePassThrough{})
+	ut.AssertEqual(t, expected, collectMap(out))
+
+	// Cache hit, the nil values are replayed as-is.
+	perf := &PerfStats{}
+	out = make(chan KeyValue, 2)
+	MapReduce(GeneratorFromSlice([]string{"A"}), out, errChan, cache, perf, &mapperNil{t: t}, &ReducePassThrough{})
+	ut.AssertEqual(t, expected, collectMap(out))
+	ut.AssertEqual(t, 1, perf.CacheHits())
+	ut.AssertEqual(t, 0, len(errChan))
+}
+
+func TestMappingCacheGetKey(t *testing.T) {
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	ut.AssertEqual(t, nil, cache.Put("A", []KeyValue{{"x", 1}, {"y", 2}}))
+	ut.AssertEqual(t, nil, cache.Put("B", []KeyValue{{"z", 3}}))
+
+	kvs, found, err := cache.GetKey("A")
+	ut.AssertEqual(t, []KeyValue{{"x", 1}, {"y", 2}}, kvs)
+	ut.AssertEqual(t, true, found)
+	ut.AssertEqual(t, nil, err)
+
+	kvs, found, err = cache.GetKey("C")
+	ut.AssertEqual(t, []KeyValue(nil), kvs)
+	ut.AssertEqual(t, false, found)
+	ut.AssertEqual(t, nil, err)
+
+	// A corrupted entry is reported but kept.
+	cache.Data["B"].Items[0].Value[0] ^= 1
+	_, found, err = cache.GetKey("B")
+	ut.AssertEqual(t, false, found)
+	ut.AssertEqual(t, "failed to decode from cache for key B: checksum mismatch", err.Error())
+	ut.AssertEqual(t, 2, len(cache.Data))
+}
+
+func TestMappingCacheGetKeyInto(t *testing.T) {
+	cache := &MappingCache{}
+	cache.SetValueType([]int{})
+	ut.AssertEqual(t, nil, cache.Put("A", []KeyValue{{"x", []int{1, 2}}, {"y", nil}}))
+
+	buf := make([]int, 0, 10)
+	dst := func() interface{} {
+		buf = buf[:0]
+		return &buf
+	}
+	kvs, err := cache.GetKeyInto("A", dst)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []KeyValue{{"x", &buf}, {"y", nil}}, kvs)
+	ut.AssertEqual(t, []int{1, 2}, buf)
+	ut.AssertEqual(t, 10, cap(buf))
+
+	kvs, err = cache.GetKeyInto("B", dst)
+	ut.AssertEqual(t, []KeyValue(nil), kvs)
+	ut.AssertEqual(t, nil, err)
+
+	_, err = cache.GetKeyInto("A", func() interface{} { return new(int) })
+	ut.AssertEqual(t, "failed to decode from cache for key A: dst returned *int, expected a non-nil *[]int", err.Error())
+}
+
+func TestMappingCacheCacheKeyFunc(t *testing.T) {
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	opts := &Options{CacheKeyFunc: strings.ToLower}
+	out := make(chan KeyValue, 1)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A"}), out, nil, cache, nil, &mapperImpl{}, &ReducePassThrough{}, opts)
+	ut.AssertEqual(t, KeyValue{"A.1", 1}, <-out)
+	_, ok := cache.Data["a"]
+	ut.AssertEqual(t, true, ok)
+
+	// Another map key with the same cache key is a hit.
+	perf := &PerfStats{}
+	out = make(chan KeyValue, 1)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"a"}), out, nil, cache, perf, &mapperImpl{t: t}, &ReducePassThrough{}, opts)
+	ut.AssertEqual(t, KeyValue{"A.1", 1}, <-out)
+	ut.AssertEqual(t, 1, perf.CacheHits())
+}
+
+func TestMappingCacheReplayOrder(t *testing.T) {
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	opts := &Options{OrderedValues: true}
+	out := make(chan KeyValue, 1)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A"}), out, nil, cache, nil, &mapperSequence{}, &reducerSequence{}, opts)
+	ut.AssertEqual(t, KeyValue{"A", true}, <-out)
+	kvs, found, err := cache.GetKey("A")
+	ut.AssertEqual(t, true, found)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 100, len(kvs))
+	for i, kv := range kvs {
+		ut.AssertEqual(t, KeyValue{"A", i}, kv)
+	}
+
+	// The cache hit replays the values in emission order.
+	perf := &PerfStats{}
+	out = make(chan KeyValue, 1)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A"}), out, nil, cache, perf, &mapperImpl{t: t}, &reducerSequence{}, opts)
+	ut.AssertEqual(t, KeyValue{"A", true}, <-out)
+	ut.AssertEqual(t, 1, perf.CacheHits())
+}
+
+func TestMappingCacheCompact(t *testing.T) {
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	MapReduce(GeneratorFromSlice([]string{"A", "B", "C", "D"}), make(chan KeyValue, 4), nil, cache, nil, &mapperImpl{}, &ReducePassThrough{})
+	cache.dirty = map[string]bool{"D": true}
+	removed, err := cache.Compact([]string{"A", "C", "E"})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 1, removed)
+	var keys []string
+	ut.AssertEqual(t, nil, cache.Walk(func(mapKey, reduceKey string) error {
+		keys = append(keys, mapKey)
+		return nil
+	}))
+	ut.AssertEqual(t, []string{"A", "C", "D"}, keys)
+}
+
+// mapperEmpty emits nothing for "A" and fails after emitting for "B".
+type mapperEmpty struct {
+	t *testing.T
+}
+
+func (m *mapperEmpty) Map(io MapIO) error {
+	if m.t != nil {
+		m.t.Fatal("This wasn't expected")
+	}
+	if io.MapKey() == "B" {
+		io.Emit("b", 1)
+		return errors.New("Oh")
+	}
+	return nil
+}
+
+func TestMappingCacheNoEmission(t *testing.T) {
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	errChan := make(chan error, 1)
+	MapReduce(GeneratorFromSlice([]string{"A", "B"}), make(chan KeyValue, 1), errChan, cache, nil, &mapperEmpty{}, &ReducePassThrough{})
+	ut.AssertEqual(t, "failed to map B: Oh", (<-errChan).Error())
+	// The partial values of the failed mapper are not cached.
+	ut.AssertEqual(t, CacheStats{Entries: 1}, cacheStats(t, cache))
+
+	// The empty result survives a round trip.
+	buf := bytes.Buffer{}
+	ut.AssertEqual(t, nil, cache.Save(&buf))
+	loaded := &MappingCache{}
+	loaded.SetValueType(0)
+	ut.AssertEqual(t, nil, loaded.Load(&buf))
+
+	perf := &PerfStats{}
+	out := make(chan KeyValue)
+	MapReduce(GeneratorFromSlice([]string{"A"}), out, nil, loaded, perf, &mapperEmpty{t: t}, &ReducePassThrough{})
+	ut.AssertEqual(t, 1, perf.CacheHits())
+	ut.AssertEqual(t, 0, len(Collect(out)))
+}
+
+// gobMissing and gobRegistered are only stored in interfaces, so gob needs
+// them to be registered. gob.Register is global, so each is only used by a
+// single test.
+type gobMissing struct {
+	X int
+}
+
+type gobRegistered struct {
+	X int
+}
+
+func TestMappingCacheRegisterGobType(t *testing.T) {
+	cache := &MappingCache{}
+	cache.SetValueType([]interface{}{})
+	errChan := make(chan error, 1)
+	mapper := mapperValues{"A": {[]interface{}{gobMissing{1}}}}
+	MapReduce(GeneratorFromSlice([]string{"A"}), make(chan KeyValue, 1), errChan, cache, nil, mapper, &ReducePassThrough{})
+	err := (<-errChan).Error()
+	ut.AssertEqual(t, true, strings.HasSuffix(err, "; register the type with MappingCache.RegisterGobType"))
+
+	cache.RegisterGobType(gobRegistered{})
+	mapper = mapperValues{"B": {[]interface{}{gobRegistered{2}}}}
+	MapReduce(GeneratorFromSlice([]string{"B"}), make(chan KeyValue, 1), errChan, cache, nil, mapper, &ReducePassThrough{})
+	ut.AssertEqual(t, 0, len(errChan))
+	kvs, found, err2 := cache.GetKey("B")
+	ut.AssertEqual(t, nil, err2)
+	ut.AssertEqual(t, true, found)
+	ut.AssertEqual(t, []KeyValue{{"k", []interface{}{gobRegistered{2}}}}, kvs)
+}
+
+func TestMapReduceOutputCache(t *testing.T) {
+	stage := &MappingCache{}
+	stage.SetValueType(0)
+	out := make(chan KeyValue, 3)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A", "B"}), out, nil, nil, nil, &mapperMulti{}, &reducerTotal{}, &Options{OutputCache: stage})
+	ut.AssertEqual(t, map[string]interface{}{"A": 6, "B": 6, "all": 20}, collectMap(out))
+	kvs, found, err := stage.GetKey("all")
+	ut.AssertEqual(t, []KeyValue{{"all", 20}}, kvs)
+	ut.AssertEqual(t, true, found)
+	ut.AssertEqual(t, nil, err)
+
+	// The second stage reads the outputs of the first one from the cache.
+	perf := &PerfStats{}
+	out = make(chan KeyValue, 3)
+	MapReduce(GeneratorFromSlice([]string{"A", "B", "all"}), out, nil, stage, perf, &mapperImpl{t: t}, &reducerTotal{})
+	ut.AssertEqual(t, map[string]interface{}{"A": 6, "B": 6, "all": 20}, collectMap(out))
+	ut.AssertEqual(t, 3, perf.CacheHits())
+}
+
+func TestMapReduceOutputCacheRerun(t *testing.T) {
+	// Running the stage again replaces the entries instead of appending to the
+	// ones left by the previous run.
+	stage := &MappingCache{}
+	stage.SetValueType(0)
+	for i := 0; i < 2; i++ {
+		out := make(chan KeyValue, 3)
+		MapReduceWithOptions(GeneratorFromSlice([]string{"A", "B"}), out, nil, nil, nil, &mapperMulti{}, &reducerTotal{}, &Options{OutputCache: stage})
+		ut.AssertEqual(t, map[string]interface{}{"A": 6, "B": 6, "all": 20}, collectMap(out))
+	}
+	kvs, found, err := stage.GetKey("A")
+	ut.AssertEqual(t, []KeyValue{{"A", 6}}, kvs)
+	ut.AssertEqual(t, true, found)
+	ut.AssertEqual(t, nil, err)
+}
+
+// gobValue implements GobEncoder with a value receiver.
+type gobValue struct {
+	s string
+}
+
+func (g gobValue) GobEncode() ([]byte, error) {
+	return []byte(g.s), nil
+}
+
+func (g *gobValue) GobDecode(b []byte) error {
+	g.s = string(b)
+	return nil
+}
+
+// gobPointer implements GobEncoder with a pointer receiver.
+type gobPointer struct {
+	s string
+}
+
+func (g *gobPointer) GobEncode() ([]byte, error) {
+	return []byte(g.s), nil
+}
+
+func (g *gobPointer) GobDecode(b []byte) error {
+	g.s = string(b)
+	return nil
+}
+
+// mapperGob emits the value types with custom gob encoding, and a pointer.
+type mapperGob struct {
+	t *testing.T
+}
+
+func (m *mapperGob) Map(io MapIO) error {
+	if m.t != nil {
+		m.t.Fatal("This wasn't expected")
+	}
+	io.Emit("value", gobValue{"a"})
+	io.Emit("pointer", gobPointer{"b"})
+	io.Emit("ptr", &gobPointer{"c"})
+	return nil
+}
+
+func TestMappingCacheGobEncoder(t *testing.T) {
+	cache := &MappingCache{}
+	cache.RegisterType(gobValue{})
+	cache.RegisterType(gobPointer{})
+	cache.RegisterType(&gobPointer{})
+	errChan := make(chan error, 3)
+	expected := map[string]interface{}{"value": gobValue{"a"}, "pointer": gobPointer{"b"}, "ptr": &gobPointer{"c"}}
+	out := make(chan KeyValue, 3)
+	MapReduce(GeneratorFromSlice([]string{"A"}), out, errChan, cache, nil, &mapperGob{}, &ReducePassThrough{})
+	ut.AssertEqual(t, expected, collectMap(out))
+	ut.AssertEqual(t, 0, len(errChan))
+
+	perf := &PerfStats{}
+	out = make(chan KeyValue, 3)
+	MapReduce(GeneratorFromSlice([]string{"A"}), out, errChan, cache, perf, &mapperGob{t: t}, &ReducePassThrough{})
+	ut.AssertEqual(t, expected, collectMap(out))
+	ut.AssertEqual(t, 1, perf.CacheHits())
+	ut.AssertEqual(t, 0, len(errChan))
+}
+
+func TestMapReduceDedupeEmits(t *testing.T) {
+	cache := &MappingCache{}
+	cache.RegisterType(0)
+	cache.RegisterType("")
+	mapper := mapperValues{"A": {1, 2, 1, "1", nil, 2, nil}}
+	out := make(chan KeyValue, 1)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A"}), out, nil, cache, nil, mapper, &ReduceCount{}, &Options{DedupeEmits: true})
+	ut.AssertEqual(t, []KeyValue{{"k", 4}}, Collect(out))
+	kvs, ok, err := cache.GetKey("A")
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, true, ok)
+	ut.AssertEqual(t, []KeyValue{{"k", 1}, {"k", 2}, {"k", "1"}, {"k", nil}}, kvs)
+
+	// Duplicates are kept by default.
+	out = make(chan KeyValue, 1)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A"}), out, nil, nil, nil, mapper, &ReduceCount{}, nil)
+	ut.AssertEqual(t, []KeyValue{{"k", 7}}, Collect(out))
+}
+
+func TestMappingCacheAccessTimes(t *testing.T) {
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	MapReduce(GeneratorFromSlice([]string{"A", "B"}), make(chan KeyValue, 2), nil, cache, nil, &mapperImpl{}, &ReducePassThrough{})
+	accessed, err := cache.AccessTimes()
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, map[string]time.Time{"A": {}, "B": {}}, accessed)
+
+	// Only A is hit on the re-run.
+	now := time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC)
+	opts := &Options{Clock: &fakeClock{now: now}}
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A"}), make(chan KeyValue, 1), nil, cache, nil, &mapperImpl{t: t}, &ReducePassThrough{}, opts)
+	accessed, err = cache.AccessTimes()
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, map[string]time.Time{"A": now, "B": {}}, accessed)
+
+	// The times persist across Save and Load.
+	buf := bytes.Buffer{}
+	ut.AssertEqual(t, nil, cache.Save(&buf))
+	loaded := &MappingCache{}
+	ut.AssertEqual(t, nil, loaded.Load(&buf))
+	loadedAccessed, err := loaded.AccessTimes()
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, true, loadedAccessed["A"].Equal(accessed["A"]))
+	ut.AssertEqual(t, true, loadedAccessed["B"].IsZero())
+
+	// Prune the keys never hit.
+	removed, err := loaded.Compact([]string{"A"})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 1, removed)
+	ut.AssertEqual(t, []string{"A"}, cachedKeys(loaded))
+}
+
+func TestMapReduceCachePredicate(t *testing.T) {
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	opts := &Options{CachePredicate: func(mapKey string) bool { return mapKey != "live" }}
+	mapper := &mapperCounted{}
+	perf := &PerfStats{}
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A", "live"}), make(chan KeyValue, 200), nil, cache, perf, mapper, &ReduceCount{}, opts)
+	ut.AssertEqual(t, []string{"A"}, cachedKeys(cache))
+	ut.AssertEqual(t, 1, perf.CacheMisses())
+
+	// The mapper always runs for "live".
+	mapper = &mapperCounted{}
+	perf = &PerfStats{}
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A", "live"}), make(chan KeyValue, 200), nil, cache, perf, mapper, &ReduceCount{}, opts)
+	ut.AssertEqual(t, int32(100), mapper.emitted)
+	ut.AssertEqual(t, 1, perf.CacheHits())
+	ut.AssertEqual(t, 0, perf.CacheMisses())
+}
+
+func TestMappingCacheExplain(t *testing.T) {
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	ut.AssertEqual(t, nil, cache.Put("A", []KeyValue{{"x", 1}, {"y", 2}}))
+	ut.AssertEqual(t, nil, cache.Put("empty", nil))
+	cache.add("dirty", nil, []CacheItem{{Key: "x"}})
+	ut.AssertEqual(t, "hit: 2 values", cache.Explain("A"))
+	ut.AssertEqual(t, "hit: no values, the mapper emitted nothing", cache.Explain("empty"))
+	ut.AssertEqual(t, "miss: being mapped by a running MapReduce", cache.Explain("dirty"))
+	ut.AssertEqual(t, "miss: not cached", cache.Explain("B"))
+
+	// The type of the values changed.
+	cache.SetValueType("")
+	ut.AssertEqual(t, "miss: item 0 (reduce key x) fails to decode and the entry will be dropped: type int is not registered", cache.Explain("A"))
+}
+
+func TestMapReduceAnnotateSource(t *testing.T) {
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	opts := &Options{AnnotateSource: true}
+	out := make(chan KeyValue, 1)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A"}), out, nil, cache, nil, &mapperImpl{}, &ReducePassThrough{}, opts)
+	ut.AssertEqual(t, []KeyValue{{"A.1", SourcedValue{1, false}}}, Collect(out))
+
+	// A is replayed from the cache while B is mapped.
+	out = make(chan KeyValue, 2)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A", "B"}), out, nil, cache, nil, &mapperImpl{}, &ReducePassThrough{}, opts)
+	expected := map[string]interface{}{"A.1": SourcedValue{1, true}, "B.1": SourcedValue{1, false}}
+	ut.AssertEqual(t, expected, collectMap(out))
+
+	// With MapOnly, each emitted value is annotated.
+	out = make(chan KeyValue, 2)
+	opts.MapOnly = true
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A", "C"}), out, nil, cache, nil, &mapperImpl{}, &ReducePassThrough{}, opts)
+	expected = map[string]interface{}{"A.1": SourcedValue{1, true}, "C.1": SourcedValue{1, false}}
+	ut.AssertEqual(t, expected, collectMap(out))
+}
@@ -0,0 +1,329 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// cacheHeader is the first item in a file written by Save.
+type cacheHeader struct {
+	Version string
+	// Framed is set when the records following the header are written like in
+	// the log, each gob encoded on its own with a size prefix, so they can be
+	// decoded concurrently. Otherwise they are part of the header's gob stream.
+	Framed bool
+}
+
+// SetVersion sets the version of the cache.
+//
+// The version is saved by Save and Load refuses to load a cache with a
+// different version. Change it every time the format of the mapper's output
+// changes so a stale cache is not fed to the reducer.
+func (c *MappingCache) SetVersion(version string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.Version = version
+}
+
+// Save writes the cache to w, one record per map key.
+//
+// Entries being mapped by a running MapReduce are not saved.
+func (c *MappingCache) Save(w io.Writer) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e := gob.NewEncoder(w)
+	if err := e.Encode(&cacheHeader{Version: c.Version, Framed: true}); err != nil {
+		return err
+	}
+	b := c.backend()
+	all, err := b.Keys()
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for _, k := range all {
+		if !c.dirty[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		items, _, err := b.Get(k)
+		if err != nil {
+			return err
+		}
+		rec, err := encodeRecord(&logRecord{MapKey: k, Items: items, Accessed: c.Accessed[k]})
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jsonKeyValue is a cached item as written by ExportJSON.
+type jsonKeyValue struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+}
+
+// ExportJSON writes the decoded content of the cache to w as an indented JSON
+// object mapping each map key to its list of {"key", "value"} items. It is
+// meant for debugging; the cache can't be loaded back from it.
+//
+// Entries being mapped by a running MapReduce are skipped. It fails on the
+// first value that can't be decoded.
+func (c *MappingCache) ExportJSON(w io.Writer) error {
+	c.lock.Lock()
+	b := c.backend()
+	data := map[string][]CacheItem{}
+	keys, err := b.Keys()
+	if err == nil {
+		for _, k := range keys {
+			if c.dirty[k] {
+				continue
+			}
+			if data[k], _, err = b.Get(k); err != nil {
+				break
+			}
+		}
+	}
+	c.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	out := make(map[string][]jsonKeyValue, len(data))
+	for k, items := range data {
+		kvs := make([]jsonKeyValue, 0, len(items))
+		for i := range items {
+			kv, err := c.decode(&items[i])
+			if err != nil {
+				return fmt.Errorf("failed to decode from cache for key %s: %s", k, err)
+			}
+			kvs = append(kvs, jsonKeyValue{kv.Key, kv.Value})
+		}
+		out[k] = kvs
+	}
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(out)
+}
+
+// Load replaces the content of the cache with the one written by Save.
+//
+// It returns an error if the version of the saved cache doesn't match the one
+// set with SetVersion, leaving the cache untouched. Map keys with a corrupted
+// value are skipped so they are mapped again.
+func (c *MappingCache) Load(r io.Reader) error {
+	return c.load(r, 1)
+}
+
+// LoadParallel is Load decoding the records on up to GOMAXPROCS goroutines,
+// to speed up loading a large cache. It produces the same cache state as
+// Load. A cache saved before the records were size prefixed is decoded
+// serially.
+func (c *MappingCache) LoadParallel(r io.Reader) error {
+	return c.load(r, runtime.GOMAXPROCS(0))
+}
+
+// load implements Load with up to workers goroutines decoding the records.
+func (c *MappingCache) load(r io.Reader, workers int) error {
+	rr, h, err := newRecordReader(r)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	version := c.Version
+	c.lock.Unlock()
+	if h.Version != version {
+		return fmt.Errorf("cache version %q doesn't match expected version %q", h.Version, version)
+	}
+
+	data := map[string][]CacheItem{}
+	accessed := map[string]time.Time{}
+	var dataLock sync.Mutex
+	add := func(rec *logRecord) {
+		if verifyItems(rec.Items) != nil {
+			return
+		}
+		// Save writes each map key once so the order doesn't matter.
+		dataLock.Lock()
+		defer dataLock.Unlock()
+		data[rec.MapKey] = rec.Items
+		if !rec.Accessed.IsZero() {
+			accessed[rec.MapKey] = rec.Accessed
+		}
+	}
+	if workers > 1 && h.Framed {
+		err = rr.forEachParallel(workers, add)
+	} else {
+		err = rr.forEach(add)
+	}
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	b := c.backend()
+	keys, err := b.Keys()
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	for k, items := range data {
+		if err := b.Put(k, items); err != nil {
+			return err
+		}
+	}
+	c.dirty = nil
+	c.Accessed = accessed
+	return nil
+}
+
+// LoadStreaming decodes a cache written by Save one map key at a time and
+// calls fn with its values, without keeping them in memory. Iteration stops
+// at the first error returned by fn, which is then returned.
+//
+// valueType is used like with SetValueType. The version of the saved cache is
+// not checked. Map keys with a corrupted value are skipped. r can be wrapped,
+// e.g. with gzip.NewReader, to read a compressed cache.
+func LoadStreaming(r io.Reader, valueType interface{}, fn func(mapKey string, kvs []KeyValue) error) error {
+	c := &MappingCache{}
+	c.SetValueType(valueType)
+	rr, _, err := newRecordReader(r)
+	if err != nil {
+		return err
+	}
+	for {
+		rec, err := rr.next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if verifyItems(rec.Items) != nil {
+			continue
+		}
+		kvs := make([]KeyValue, 0, len(rec.Items))
+		for i := range rec.Items {
+			kv, err := c.decode(&rec.Items[i])
+			if err != nil {
+				return fmt.Errorf("failed to decode from cache for key %s: %s", rec.MapKey, err)
+			}
+			kvs = append(kvs, kv)
+		}
+		if err := fn(rec.MapKey, kvs); err != nil {
+			return err
+		}
+	}
+}
+
+// recordReader reads the records of a cache written by Save.
+type recordReader struct {
+	r      *bufio.Reader
+	d      *gob.Decoder
+	framed bool // cacheHeader.Framed.
+}
+
+// newRecordReader reads the header of a cache written by Save.
+func newRecordReader(r io.Reader) (*recordReader, cacheHeader, error) {
+	// gob doesn't read past the messages it decodes from an io.ByteReader, so
+	// the framed records can then be read from the same bufio.Reader.
+	br := bufio.NewReader(r)
+	d := gob.NewDecoder(br)
+	h := cacheHeader{}
+	if err := d.Decode(&h); err != nil {
+		return nil, h, err
+	}
+	return &recordReader{br, d, h.Framed}, h, nil
+}
+
+// next returns the next record, or io.EOF once all were read.
+func (rr *recordReader) next() (*logRecord, error) {
+	if !rr.framed {
+		rec := &logRecord{}
+		if err := rr.d.Decode(rec); err != nil {
+			return nil, err
+		}
+		return rec, nil
+	}
+	b, err := readRecord(rr.r)
+	if err != nil {
+		return nil, err
+	}
+	return decodeRecord(b)
+}
+
+// forEach calls fn with each remaining record.
+func (rr *recordReader) forEach(fn func(rec *logRecord)) error {
+	for {
+		rec, err := rr.next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		fn(rec)
+	}
+}
+
+// forEachParallel is forEach decoding the framed records on workers
+// goroutines. fn is called concurrently.
+func (rr *recordReader) forEachParallel(workers int, fn func(rec *logRecord)) error {
+	frames := make(chan []byte, workers)
+	var errLock sync.Mutex
+	var decodeErr error
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range frames {
+				rec, err := decodeRecord(b)
+				if err != nil {
+					errLock.Lock()
+					if decodeErr == nil {
+						decodeErr = err
+					}
+					errLock.Unlock()
+					continue
+				}
+				fn(rec)
+			}
+		}()
+	}
+	var err error
+	for {
+		var b []byte
+		if b, err = readRecord(rr.r); err != nil {
+			break
+		}
+		frames <- b
+	}
+	close(frames)
+	wg.Wait()
+	if err != io.EOF {
+		return err
+	}
+	return decodeErr
+}
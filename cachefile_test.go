@@ -0,0 +1,200 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func TestMappingCacheSaveLoad(t *testing.T) {
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	cache.SetVersion("v1")
+	MapReduce(GeneratorFromSlice([]string{"A", "B"}), make(chan KeyValue, 2), nil, cache, nil, &mapperImpl{}, &ReducePassThrough{})
+	buf := bytes.Buffer{}
+	ut.AssertEqual(t, nil, cache.Save(&buf))
+
+	loaded := &MappingCache{}
+	loaded.SetValueType(0)
+	loaded.SetVersion("v1")
+	ut.AssertEqual(t, nil, loaded.Load(bytes.NewReader(buf.Bytes())))
+	ut.AssertEqual(t, cache.Data, loaded.Data)
+
+	perf := &PerfStats{}
+	out := make(chan KeyValue, 2)
+	MapReduce(GeneratorFromSlice([]string{"A", "B"}), out, nil, loaded, perf, &mapperImpl{t: t}, &ReducePassThrough{})
+	ut.AssertEqual(t, 2, perf.CacheHits())
+	ut.AssertEqual(t, map[string]interface{}{"A.1": 1, "B.1": 1}, collectMap(out))
+}
+
+func TestMappingCacheLoadVersionMismatch(t *testing.T) {
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	cache.SetVersion("v1")
+	MapReduce(GeneratorFromSlice([]string{"A"}), make(chan KeyValue, 1), nil, cache, nil, &mapperImpl{}, &ReducePassThrough{})
+	buf := bytes.Buffer{}
+	ut.AssertEqual(t, nil, cache.Save(&buf))
+
+	loaded := &MappingCache{}
+	loaded.SetVersion("v2")
+	err := loaded.Load(&buf)
+	ut.AssertEqual(t, "cache version \"v1\" doesn't match expected version \"v2\"", err.Error())
+	ut.AssertEqual(t, 0, len(loaded.Data))
+}
+
+func TestMappingCacheLoadChecksum(t *testing.T) {
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	MapReduce(GeneratorFromSlice([]string{"A", "B"}), make(chan KeyValue, 2), nil, cache, nil, &mapperImpl{}, &ReducePassThrough{})
+	// Flip a bit in a value, as a partial write would.
+	cache.Data["A"].Items[0].Value[0] ^= 1
+	buf := bytes.Buffer{}
+	ut.AssertEqual(t, nil, cache.Save(&buf))
+
+	loaded := &MappingCache{}
+	loaded.SetValueType(0)
+	ut.AssertEqual(t, nil, loaded.Load(&buf))
+	_, ok := loaded.Data["A"]
+	ut.AssertEqual(t, false, ok)
+	_, ok = loaded.Data["B"]
+	ut.AssertEqual(t, true, ok)
+
+	// Corruption of the in-memory cache is a miss.
+	errChan := make(chan error, 1)
+	perf := &PerfStats{}
+	out := make(chan KeyValue, 1)
+	MapReduce(GeneratorFromSlice([]string{"A"}), out, errChan, cache, perf, &mapperImpl{}, &ReducePassThrough{})
+	ut.AssertEqual(t, "failed to decode from cache for key A: checksum mismatch", (<-errChan).Error())
+	ut.AssertEqual(t, 1, perf.CacheMisses())
+	ut.AssertEqual(t, KeyValue{"A.1", 1}, <-out)
+}
+
+func TestMappingCacheLoadParallel(t *testing.T) {
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%03d", i)
+	}
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	MapReduce(GeneratorFromSlice(keys), make(chan KeyValue, len(keys)), nil, cache, nil, &mapperImpl{}, &ReducePassThrough{})
+	cache.Data["042"].Items[0].Value[0] ^= 1
+	buf := bytes.Buffer{}
+	ut.AssertEqual(t, nil, cache.Save(&buf))
+
+	serial := &MappingCache{}
+	ut.AssertEqual(t, nil, serial.Load(bytes.NewReader(buf.Bytes())))
+	parallel := &MappingCache{}
+	ut.AssertEqual(t, nil, parallel.LoadParallel(bytes.NewReader(buf.Bytes())))
+	ut.AssertEqual(t, 99, len(parallel.Data))
+	ut.AssertEqual(t, serial.Data, parallel.Data)
+
+	// A truncated record is an error.
+	parallel = &MappingCache{}
+	err := parallel.LoadParallel(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	ut.AssertEqual(t, io.ErrUnexpectedEOF, err)
+	ut.AssertEqual(t, 0, len(parallel.Data))
+}
+
+func TestMappingCacheLoadUnframed(t *testing.T) {
+	// A cache saved as a single gob stream, before the records were size
+	// prefixed, is still loaded.
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	MapReduce(GeneratorFromSlice([]string{"A", "B"}), make(chan KeyValue, 2), nil, cache, nil, &mapperImpl{}, &ReducePassThrough{})
+	buf := bytes.Buffer{}
+	e := gob.NewEncoder(&buf)
+	ut.AssertEqual(t, nil, e.Encode(&cacheHeader{}))
+	for _, k := range []string{"A", "B"} {
+		ut.AssertEqual(t, nil, e.Encode(&logRecord{MapKey: k, Items: cache.Data[k].Items}))
+	}
+
+	for _, parallel := range []bool{false, true} {
+		loaded := &MappingCache{}
+		loaded.SetValueType(0)
+		if parallel {
+			ut.AssertEqual(t, nil, loaded.LoadParallel(bytes.NewReader(buf.Bytes())))
+		} else {
+			ut.AssertEqual(t, nil, loaded.Load(bytes.NewReader(buf.Bytes())))
+		}
+		kvs, _, err := loaded.GetKey("B")
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, []KeyValue{{"B.1", 1}}, kvs)
+	}
+	var keys []string
+	err := LoadStreaming(bytes.NewReader(buf.Bytes()), 0, func(mapKey string, kvs []KeyValue) error {
+		keys = append(keys, mapKey)
+		return nil
+	})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{"A", "B"}, keys)
+}
+
+func TestLoadStreaming(t *testing.T) {
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	MapReduce(GeneratorFromSlice([]string{"A", "B", "C"}), make(chan KeyValue, 3), nil, cache, nil, &mapperImpl{}, &ReducePassThrough{})
+	cache.Data["B"].Items[0].Value[0] ^= 1
+	buf := bytes.Buffer{}
+	zw := gzip.NewWriter(&buf)
+	ut.AssertEqual(t, nil, cache.Save(zw))
+	ut.AssertEqual(t, nil, zw.Close())
+
+	zr, err := gzip.NewReader(bytes.NewReader(buf.Bytes()))
+	ut.AssertEqual(t, nil, err)
+	var keys []string
+	err = LoadStreaming(zr, 0, func(mapKey string, kvs []KeyValue) error {
+		keys = append(keys, mapKey)
+		ut.AssertEqual(t, []KeyValue{{mapKey + ".1", 1}}, kvs)
+		return nil
+	})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{"A", "C"}, keys)
+
+	// The callback error stops the iteration.
+	stop := errors.New("stop")
+	keys = nil
+	buf.Reset()
+	ut.AssertEqual(t, nil, cache.Save(&buf))
+	err = LoadStreaming(&buf, 0, func(mapKey string, kvs []KeyValue) error {
+		keys = append(keys, mapKey)
+		return stop
+	})
+	ut.AssertEqual(t, stop, err)
+	ut.AssertEqual(t, []string{"A"}, keys)
+}
+
+func TestMappingCacheExportJSON(t *testing.T) {
+	cache := &MappingCache{}
+	cache.RegisterType(0)
+	cache.RegisterType(point{})
+	MapReduce(GeneratorFromSlice([]string{"A"}), make(chan KeyValue, 2), nil, cache, nil, &mapperMixed{}, &ReducePassThrough{})
+	buf := bytes.Buffer{}
+	ut.AssertEqual(t, nil, cache.ExportJSON(&buf))
+	expected := `{
+  "A": [
+    {
+      "key": "int",
+      "value": 1
+    },
+    {
+      "key": "point",
+      "value": {
+        "X": 2,
+        "Y": 3
+      }
+    }
+  ]
+}
+`
+	ut.AssertEqual(t, expected, buf.String())
+}
@@ -0,0 +1,180 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// logRecord is the cached result of a single map key, as written in the log.
+type logRecord struct {
+	MapKey   string
+	Items    []CacheItem
+	Accessed time.Time // Last cache hit; only set by Save.
+	Version  string    // Version of the cache; only set in the log.
+}
+
+// OpenLog opens an append-only log at path. From then on, the cached values
+// of each map key are appended to the log as soon as its mapper completes
+// successfully, so a crash mid-run only loses the keys that were being mapped.
+//
+// The records are written straight to the file without calling fsync, so they
+// survive a process crash but not necessarily a system crash. Use LoadLog to
+// reconstruct the cache from the log. Each record is tagged with the version
+// set with SetVersion.
+func (c *MappingCache) OpenLog(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	c.logLock.Lock()
+	defer c.logLock.Unlock()
+	if c.log != nil {
+		_ = f.Close()
+		return errors.New("log is already open")
+	}
+	c.log = f
+	return nil
+}
+
+// CloseLog closes the log opened with OpenLog.
+func (c *MappingCache) CloseLog() error {
+	c.logLock.Lock()
+	defer c.logLock.Unlock()
+	if c.log == nil {
+		return nil
+	}
+	err := c.log.Close()
+	c.log = nil
+	return err
+}
+
+// LoadLog replays the log at path written via OpenLog into the cache.
+//
+// When a map key is found multiple times, the last record wins. A truncated
+// last record, as left by a crash, is silently ignored. A record with a
+// corrupted value is skipped so the map key is mapped again.
+//
+// Like Load, it returns an error if a record was written with a version other
+// than the one set with SetVersion, leaving the cache untouched.
+func (c *MappingCache) LoadLog(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	c.lock.Lock()
+	version := c.Version
+	c.lock.Unlock()
+	var records []*logRecord
+	r := bufio.NewReader(f)
+	for {
+		buf, err := readRecord(r)
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return err
+		}
+		rec, err := decodeRecord(buf)
+		if err != nil {
+			return err
+		}
+		if rec.Version != version {
+			return fmt.Errorf("log record version %q doesn't match expected version %q", rec.Version, version)
+		}
+		records = append(records, rec)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, rec := range records {
+		var err error
+		if verifyItems(rec.Items) == nil {
+			err = c.backend().Put(rec.MapKey, rec.Items)
+		} else {
+			err = c.backend().Delete(rec.MapKey)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendLog appends the cached values of mapKey to the log, if one is open.
+func (c *MappingCache) appendLog(mapKey string) error {
+	c.logLock.Lock()
+	defer c.logLock.Unlock()
+	if c.log == nil {
+		return nil
+	}
+	rec := logRecord{MapKey: mapKey}
+	c.lock.Lock()
+	var err error
+	rec.Items, _, err = c.backend().Get(mapKey)
+	rec.Version = c.Version
+	c.lock.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to read log record for key %s: %s", mapKey, err)
+	}
+
+	b, err := encodeRecord(&rec)
+	if err != nil {
+		return fmt.Errorf("failed to encode log record for key %s: %s", mapKey, err)
+	}
+	if _, err := c.log.Write(b); err != nil {
+		return fmt.Errorf("failed to write log record for key %s: %s", mapKey, err)
+	}
+	return nil
+}
+
+// encodeRecord returns rec gob encoded on its own, so it can be decoded
+// independently of the other records, prefixed with its size.
+func encodeRecord(rec *logRecord) ([]byte, error) {
+	buf := bytes.Buffer{}
+	// Reserve space for the size prefix.
+	buf.Write([]byte{0, 0, 0, 0})
+	if err := gob.NewEncoder(&buf).Encode(rec); err != nil {
+		return nil, err
+	}
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	return b, nil
+}
+
+// readRecord reads a record written by encodeRecord without decoding it. It
+// returns io.EOF at the end of r and io.ErrUnexpectedEOF if the record is
+// truncated.
+func readRecord(r io.Reader) ([]byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+// decodeRecord decodes a record returned by readRecord.
+func decodeRecord(b []byte) (*logRecord, error) {
+	rec := &logRecord{}
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(rec); err != nil {
+		return nil, fmt.Errorf("failed to decode log record: %s", err)
+	}
+	return rec, nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func TestMappingCacheLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.log")
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	ut.AssertEqual(t, nil, cache.OpenLog(path))
+	errChan := make(chan error, 1)
+	out := make(chan KeyValue, 2)
+	MapReduce(GeneratorFromSlice([]string{"A", "B"}), out, errChan, cache, nil, &mapperImpl{}, &ReducePassThrough{})
+	// A failed mapper is not logged.
+	MapReduce(GeneratorFromSlice([]string{"C"}), make(chan KeyValue), errChan, cache, nil, &mapperImpl{err: errors.New("Oh")}, &ReducePassThrough{})
+	ut.AssertEqual(t, "failed to map C: Oh", (<-errChan).Error())
+	ut.AssertEqual(t, nil, cache.CloseLog())
+
+	loaded := &MappingCache{}
+	loaded.SetValueType(0)
+	ut.AssertEqual(t, nil, loaded.LoadLog(path))
+	ut.AssertEqual(t, 2, len(loaded.Data))
+	perf := &PerfStats{}
+	out = make(chan KeyValue, 2)
+	MapReduce(GeneratorFromSlice([]string{"A", "B"}), out, errChan, loaded, perf, &mapperImpl{t: t}, &ReducePassThrough{})
+	ut.AssertEqual(t, 2, perf.CacheHits())
+	ut.AssertEqual(t, map[string]interface{}{"A.1": 1, "B.1": 1}, collectMap(out))
+}
+
+func TestMappingCacheLogTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.log")
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	ut.AssertEqual(t, nil, cache.OpenLog(path))
+	MapReduce(GeneratorFromSlice([]string{"A"}), make(chan KeyValue, 1), nil, cache, nil, &mapperImpl{}, &ReducePassThrough{})
+	MapReduce(GeneratorFromSlice([]string{"B"}), make(chan KeyValue, 1), nil, cache, nil, &mapperImpl{}, &ReducePassThrough{})
+	ut.AssertEqual(t, nil, cache.CloseLog())
+
+	// Simulate a crash in the middle of writing the second record.
+	fi, err := os.Stat(path)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, os.Truncate(path, fi.Size()-3))
+
+	loaded := &MappingCache{}
+	ut.AssertEqual(t, nil, loaded.LoadLog(path))
+	ut.AssertEqual(t, 1, len(loaded.Data))
+	_, ok := loaded.Data["A"]
+	ut.AssertEqual(t, true, ok)
+}
+
+func TestMappingCacheLogVersionMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.log")
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	cache.SetVersion("v1")
+	ut.AssertEqual(t, nil, cache.OpenLog(path))
+	MapReduce(GeneratorFromSlice([]string{"A"}), make(chan KeyValue, 1), nil, cache, nil, &mapperImpl{}, &ReducePassThrough{})
+	ut.AssertEqual(t, nil, cache.CloseLog())
+
+	loaded := &MappingCache{}
+	loaded.SetValueType(0)
+	loaded.SetVersion("v2")
+	ut.AssertEqual(t, "log record version \"v1\" doesn't match expected version \"v2\"", loaded.LoadLog(path).Error())
+	ut.AssertEqual(t, 0, len(loaded.Data))
+
+	loaded.SetVersion("v1")
+	ut.AssertEqual(t, nil, loaded.LoadLog(path))
+	ut.AssertEqual(t, 1, len(loaded.Data))
+}
@@ -0,0 +1,138 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import "container/list"
+
+// SetMaxBytes bounds the total size of the serialized values in the cache to
+// n bytes. Once exceeded, the least recently used entries are evicted until
+// the cache fits. An entry is used when it is written or is a cache hit. 0
+// means unlimited, which is the default.
+//
+// Since the size of each entry is what is accounted for, it gives real memory
+// control even when the entries vary widely in size. The entries being mapped
+// by a running MapReduce and the most recently used entry are never evicted,
+// so the cache can temporarily exceed n.
+//
+// It must be called after SetStore. The entries already cached are accounted
+// for in an arbitrary order. An error is returned if the CacheStore fails; the
+// limit is then not set.
+func (c *MappingCache) SetMaxBytes(n int64) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if n <= 0 {
+		c.lru = nil
+		return nil
+	}
+	if c.lru == nil {
+		l := &lruStore{c: c, order: list.New(), entries: map[string]*list.Element{}}
+		keys, err := l.inner().Keys()
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			items, _, err := l.inner().Get(k)
+			if err != nil {
+				return err
+			}
+			l.track(k, items)
+		}
+		c.lru = l
+	}
+	c.lru.max = n
+	return c.lru.evict()
+}
+
+// lruStore is the CacheStore used with SetMaxBytes. It wraps the CacheStore
+// in use to track the size and the last use of each entry. c.lock must be
+// held.
+type lruStore struct {
+	c       *MappingCache
+	max     int64
+	size    int64
+	order   *list.List // *lruEntry, most recently used first.
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	mapKey string
+	size   int64
+}
+
+// inner returns the CacheStore wrapped.
+func (l *lruStore) inner() CacheStore {
+	if l.c.store != nil {
+		return l.c.store
+	}
+	return dataStore{l.c}
+}
+
+// Get doesn't count as a use since it is also used by Save, Stats, etc. A
+// cache hit is recorded with touch.
+func (l *lruStore) Get(mapKey string) ([]CacheItem, bool, error) {
+	return l.inner().Get(mapKey)
+}
+
+func (l *lruStore) Put(mapKey string, items []CacheItem) error {
+	if err := l.inner().Put(mapKey, items); err != nil {
+		return err
+	}
+	l.track(mapKey, items)
+	return l.evict()
+}
+
+func (l *lruStore) Delete(mapKey string) error {
+	if err := l.inner().Delete(mapKey); err != nil {
+		return err
+	}
+	if e, ok := l.entries[mapKey]; ok {
+		l.size -= e.Value.(*lruEntry).size
+		l.order.Remove(e)
+		delete(l.entries, mapKey)
+	}
+	return nil
+}
+
+func (l *lruStore) Keys() ([]string, error) {
+	return l.inner().Keys()
+}
+
+// touch marks mapKey as the most recently used entry.
+func (l *lruStore) touch(mapKey string) {
+	if e, ok := l.entries[mapKey]; ok {
+		l.order.MoveToFront(e)
+	}
+}
+
+// track records the size of mapKey and marks it as the most recently used.
+func (l *lruStore) track(mapKey string, items []CacheItem) {
+	var size int64
+	for _, i := range items {
+		size += int64(len(i.Value))
+	}
+	if e, ok := l.entries[mapKey]; ok {
+		entry := e.Value.(*lruEntry)
+		l.size += size - entry.size
+		entry.size = size
+		l.order.MoveToFront(e)
+		return
+	}
+	l.entries[mapKey] = l.order.PushFront(&lruEntry{mapKey, size})
+	l.size += size
+}
+
+// evict deletes the least recently used entries until the cache fits.
+func (l *lruStore) evict() error {
+	for e := l.order.Back(); e != nil && e != l.order.Front() && l.size > l.max; {
+		prev := e.Prev()
+		if k := e.Value.(*lruEntry).mapKey; !l.c.dirty[k] {
+			if err := l.Delete(k); err != nil {
+				return err
+			}
+		}
+		e = prev
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func cachedKeys(c *MappingCache) []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	keys, _ := c.backend().Keys()
+	sort.Strings(keys)
+	return keys
+}
+
+func cacheStats(t *testing.T, c *MappingCache) CacheStats {
+	s, err := c.Stats()
+	ut.AssertEqual(t, nil, err)
+	return s
+}
+
+func TestMappingCacheSetMaxBytes(t *testing.T) {
+	cache := &MappingCache{}
+	cache.SetValueType("")
+	ut.AssertEqual(t, nil, cache.Put("A", []KeyValue{{"x", strings.Repeat("a", 100)}}))
+	size := cacheStats(t, cache).Bytes
+	// Room for two entries and a half.
+	ut.AssertEqual(t, nil, cache.SetMaxBytes(size*2+size/2))
+	ut.AssertEqual(t, nil, cache.Put("B", []KeyValue{{"x", strings.Repeat("b", 100)}}))
+	ut.AssertEqual(t, []string{"A", "B"}, cachedKeys(cache))
+
+	// A cache hit on A makes B the least recently used.
+	_, ok, err := cache.GetKey("A")
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, true, ok)
+	ut.AssertEqual(t, nil, cache.Put("C", []KeyValue{{"x", strings.Repeat("c", 100)}}))
+	ut.AssertEqual(t, []string{"A", "C"}, cachedKeys(cache))
+	ut.AssertEqual(t, size*2, cacheStats(t, cache).Bytes)
+
+	// A single large entry evicts the others but is kept.
+	ut.AssertEqual(t, nil, cache.Put("D", []KeyValue{{"x", strings.Repeat("d", 1000)}}))
+	ut.AssertEqual(t, []string{"D"}, cachedKeys(cache))
+
+	ut.AssertEqual(t, nil, cache.SetMaxBytes(0))
+	ut.AssertEqual(t, nil, cache.Put("E", []KeyValue{{"x", strings.Repeat("e", 1000)}}))
+	ut.AssertEqual(t, []string{"D", "E"}, cachedKeys(cache))
+}
+
+func TestMappingCacheSetMaxBytesRun(t *testing.T) {
+	cache := &MappingCache{}
+	cache.SetValueType(1)
+	ut.AssertEqual(t, nil, cache.SetMaxBytes(1))
+	// The entries being mapped are not evicted until the run completes, then
+	// only the last one written is kept.
+	mapper := mapperValues{"A": {1, 2}, "B": {3, 4}}
+	out := make(chan KeyValue, 4)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A", "B"}), out, nil, cache, nil, mapper, &ReducePassThrough{}, &Options{Deterministic: true})
+	ut.AssertEqual(t, 4, len(Collect(out)))
+	ut.AssertEqual(t, []string{"B"}, cachedKeys(cache))
+	kvs, _, _ := cache.GetKey("B")
+	ut.AssertEqual(t, []KeyValue{{"k", 3}, {"k", 4}}, kvs)
+}
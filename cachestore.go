@@ -0,0 +1,84 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+// CacheStore is the storage backend of a MappingCache, e.g. to back a cache
+// larger than RAM with files on disk or an embedded database.
+//
+// MappingCache serializes all the calls so an implementation doesn't need to
+// be safe for concurrent use. The items are already serialized and
+// checksummed; a store only needs to persist them as-is.
+//
+// The errors returned, e.g. on I/O failure, are returned by the MappingCache
+// methods or sent to errChan during a MapReduce. A map key whose items can't be
+// read is a cache miss and a map key whose items can't be written is mapped
+// again in the next run.
+type CacheStore interface {
+	// Get returns the items of mapKey and whether mapKey is in the store.
+	Get(mapKey string) ([]CacheItem, bool, error)
+	// Put stores items for mapKey, replacing any previous items.
+	Put(mapKey string, items []CacheItem) error
+	// Delete removes mapKey from the store, if present.
+	Delete(mapKey string) error
+	// Keys returns all the map keys in the store, in any order.
+	Keys() ([]string, error)
+}
+
+// SetStore sets the storage backend of the cache. By default, the entries are
+// kept in memory in Data, which is what is serialized when the MappingCache
+// itself is encoded.
+//
+// It must be called before usage; the entries already cached are not copied
+// to s.
+func (c *MappingCache) SetStore(s CacheStore) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.store = s
+}
+
+// backend returns the CacheStore in use. c.lock must be held.
+func (c *MappingCache) backend() CacheStore {
+	if c.lru != nil {
+		return c.lru
+	}
+	if c.store != nil {
+		return c.store
+	}
+	return dataStore{c}
+}
+
+// dataStore is the default CacheStore, backed by MappingCache.Data.
+type dataStore struct {
+	c *MappingCache
+}
+
+func (d dataStore) Get(mapKey string) ([]CacheItem, bool, error) {
+	v, ok := d.c.Data[mapKey]
+	if !ok {
+		return nil, false, nil
+	}
+	return v.Items, true, nil
+}
+
+func (d dataStore) Put(mapKey string, items []CacheItem) error {
+	if d.c.Data == nil {
+		d.c.Data = make(map[string]*cacheValues)
+	}
+	d.c.Data[mapKey] = &cacheValues{Items: items}
+	return nil
+}
+
+func (d dataStore) Delete(mapKey string) error {
+	delete(d.c.Data, mapKey)
+	return nil
+}
+
+func (d dataStore) Keys() ([]string, error) {
+	keys := make([]string, 0, len(d.c.Data))
+	for k := range d.c.Data {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+// memoryStore is a CacheStore that records the number of calls to Put. Put
+// fails with err when set.
+type memoryStore struct {
+	items map[string][]CacheItem
+	puts  int
+	err   error
+}
+
+func (m *memoryStore) Get(mapKey string) ([]CacheItem, bool, error) {
+	items, ok := m.items[mapKey]
+	return items, ok, nil
+}
+
+func (m *memoryStore) Put(mapKey string, items []CacheItem) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.items[mapKey] = items
+	m.puts++
+	return nil
+}
+
+func (m *memoryStore) Delete(mapKey string) error {
+	delete(m.items, mapKey)
+	return nil
+}
+
+func (m *memoryStore) Keys() ([]string, error) {
+	keys := make([]string, 0, len(m.items))
+	for k := range m.items {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func TestMappingCacheSetStore(t *testing.T) {
+	store := &memoryStore{items: map[string][]CacheItem{}}
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	cache.SetStore(store)
+	MapReduce(GeneratorFromSlice([]string{"A", "B"}), make(chan KeyValue, 2), nil, cache, nil, &mapperImpl{}, &ReducePassThrough{})
+	ut.AssertEqual(t, 2, len(store.items))
+	ut.AssertEqual(t, 2, store.puts)
+	ut.AssertEqual(t, 0, len(cache.Data))
+	ut.AssertEqual(t, 2, cacheStats(t, cache).Entries)
+
+	perf := &PerfStats{}
+	out := make(chan KeyValue, 2)
+	MapReduce(GeneratorFromSlice([]string{"A", "B"}), out, nil, cache, perf, &mapperImpl{t: t}, &ReducePassThrough{})
+	ut.AssertEqual(t, 2, perf.CacheHits())
+	ut.AssertEqual(t, map[string]interface{}{"A.1": 1, "B.1": 1}, collectMap(out))
+
+	// Save and Load go through the store.
+	buf := bytes.Buffer{}
+	ut.AssertEqual(t, nil, cache.Save(&buf))
+	other := &memoryStore{items: map[string][]CacheItem{"C": nil}}
+	loaded := &MappingCache{}
+	loaded.SetStore(other)
+	ut.AssertEqual(t, nil, loaded.Load(&buf))
+	ut.AssertEqual(t, store.items, other.items)
+}
+
+func TestMappingCacheSetStoreError(t *testing.T) {
+	store := &memoryStore{items: map[string][]CacheItem{}, err: errors.New("disk full")}
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	cache.SetStore(store)
+	ut.AssertEqual(t, store.err, cache.Put("A", []KeyValue{{"x", 1}}))
+
+	// The failure is reported and the map key is mapped again next time.
+	errChan := make(chan error, 2)
+	out := make(chan KeyValue, 1)
+	MapReduce(GeneratorFromSlice([]string{"A"}), out, errChan, cache, nil, &mapperImpl{}, &ReducePassThrough{})
+	ut.AssertEqual(t, []KeyValue{{"A.1", 1}}, Collect(out))
+	ut.AssertEqual(t, "failed to write to cache key A: disk full", (<-errChan).Error())
+	ut.AssertEqual(t, 0, len(errChan))
+	ut.AssertEqual(t, 0, len(store.items))
+
+	store.err = nil
+	perf := &PerfStats{}
+	out = make(chan KeyValue, 1)
+	MapReduce(GeneratorFromSlice([]string{"A"}), out, errChan, cache, perf, &mapperImpl{}, &ReducePassThrough{})
+	ut.AssertEqual(t, 1, perf.CacheMisses())
+	ut.AssertEqual(t, 1, len(store.items))
+}
@@ -0,0 +1,112 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// MapError is sent to errChan when a mapper fails.
+type MapError struct {
+	Key string // Map key.
+	Err error  // Error returned by the mapper.
+}
+
+func (e *MapError) Error() string {
+	return fmt.Sprintf("failed to map %s: %s", e.Key, e.Err)
+}
+
+// Unwrap returns the error returned by the mapper.
+func (e *MapError) Unwrap() error {
+	return e.Err
+}
+
+// ReduceError is sent to errChan when a reducer fails.
+type ReduceError struct {
+	Key string // Reduce key.
+	Err error  // Error returned by the reducer.
+}
+
+func (e *ReduceError) Error() string {
+	return fmt.Sprintf("failed to reduce %s: %s", e.Key, e.Err)
+}
+
+// Unwrap returns the error returned by the reducer.
+func (e *ReduceError) Unwrap() error {
+	return e.Err
+}
+
+// Warning is reported by a mapper with MapIO.Warn. Unlike a MapError, the
+// values emitted for the map key are kept.
+type Warning struct {
+	Key string // Map key.
+	Err error  // The formatted warning.
+}
+
+func (w *Warning) Error() string {
+	return fmt.Sprintf("warning for %s: %s", w.Key, w.Err)
+}
+
+// Unwrap returns the formatted warning.
+func (w *Warning) Unwrap() error {
+	return w.Err
+}
+
+// TypeMismatchError is sent to errChan, wrapped in a MapError, when a mapper
+// emits a value of an unexpected type, as set with MappingCache.SetValueType or
+// Options.ExpectValueType. It is returned as is by MappingCache.Put.
+type TypeMismatchError struct {
+	Expected reflect.Type
+	Got      reflect.Type // nil for a nil value.
+}
+
+func (e *TypeMismatchError) Error() string {
+	return fmt.Sprintf("expected type %v, got %v", e.Expected, e.Got)
+}
+
+// SortErrors returns a copy of errs, as received from errChan, in a
+// deterministic order: the MapError sorted by map key first, then the
+// ReduceError sorted by reduce key, then the Warning sorted by map key, then
+// the other errors in their original order.
+func SortErrors(errs []error) []error {
+	out := make([]error, len(errs))
+	copy(out, errs)
+	sort.Stable(errorSlice(out))
+	return out
+}
+
+type errorSlice []error
+
+func (e errorSlice) Len() int {
+	return len(e)
+}
+
+func (e errorSlice) Less(i, j int) bool {
+	pi, ki := errorOrder(e[i])
+	pj, kj := errorOrder(e[j])
+	if pi != pj {
+		return pi < pj
+	}
+	return ki < kj
+}
+
+func (e errorSlice) Swap(i, j int) {
+	e[i], e[j] = e[j], e[i]
+}
+
+// errorOrder returns the phase and the key err is sorted by.
+func errorOrder(err error) (int, string) {
+	switch e := err.(type) {
+	case *MapError:
+		return 0, e.Key
+	case *ReduceError:
+		return 1, e.Key
+	case *Warning:
+		return 2, e.Key
+	}
+	return 3, ""
+}
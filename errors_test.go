@@ -0,0 +1,157 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+// reducerFailing fails for every reduce key.
+type reducerFailing struct {
+	err error
+}
+
+func (r *reducerFailing) Reduce(io ReduceIO) error {
+	return r.err
+}
+
+func TestMapError(t *testing.T) {
+	oh := errors.New("Oh")
+	_, errs := RunInMemory([]string{"A"}, &mapperImpl{err: oh}, &ReducePassThrough{})
+	ut.AssertEqual(t, 1, len(errs))
+	var mapErr *MapError
+	ut.AssertEqual(t, true, errors.As(errs[0], &mapErr))
+	ut.AssertEqual(t, "A", mapErr.Key)
+	ut.AssertEqual(t, true, errors.Is(errs[0], oh))
+}
+
+func TestReduceError(t *testing.T) {
+	oh := errors.New("Oh")
+	_, errs := RunInMemory([]string{"A"}, &mapperImpl{}, &reducerFailing{oh})
+	ut.AssertEqual(t, 1, len(errs))
+	ut.AssertEqual(t, "failed to reduce A.1: Oh", errs[0].Error())
+	var reduceErr *ReduceError
+	ut.AssertEqual(t, true, errors.As(errs[0], &reduceErr))
+	ut.AssertEqual(t, "A.1", reduceErr.Key)
+	ut.AssertEqual(t, true, errors.Is(errs[0], oh))
+}
+
+func TestTypeMismatchError(t *testing.T) {
+	cache := &MappingCache{}
+	cache.SetValueType("")
+	errChan := make(chan error, 1)
+	MapReduce(GeneratorFromSlice([]string{"A"}), make(chan KeyValue, 1), errChan, cache, nil, &mapperImpl{}, &ReducePassThrough{})
+	var typeErr *TypeMismatchError
+	ut.AssertEqual(t, true, errors.As(<-errChan, &typeErr))
+	ut.AssertEqual(t, reflect.TypeOf(""), typeErr.Expected)
+	ut.AssertEqual(t, reflect.TypeOf(0), typeErr.Got)
+}
+
+func TestSortErrors(t *testing.T) {
+	other := errors.New("other")
+	errs := []error{
+		&ReduceError{"b", other},
+		other,
+		&MapError{"z", other},
+		&ReduceError{"a", other},
+		&MapError{"y", other},
+	}
+	expected := []error{errs[4], errs[2], errs[3], errs[0], errs[1]}
+	ut.AssertEqual(t, expected, SortErrors(errs))
+	// errs is not modified.
+	ut.AssertEqual(t, other, errs[1])
+}
+
+func TestSortErrorsRun(t *testing.T) {
+	oh := errors.New("Oh")
+	_, errs := RunInMemory([]string{"C", "A", "D", "B"}, &mapperImpl{err: oh}, &ReducePassThrough{})
+	actual := []string{}
+	for _, err := range SortErrors(errs) {
+		actual = append(actual, err.Error())
+	}
+	ut.AssertEqual(t, []string{"failed to map A: Oh", "failed to map B: Oh", "failed to map C: Oh", "failed to map D: Oh"}, actual)
+}
+
+// mapperWarning warns about the map key and emits (key.1, 1).
+type mapperWarning struct {
+}
+
+func (m *mapperWarning) Map(io MapIO) error {
+	io.Warn("missing field %q", "name")
+	io.Emit(io.MapKey()+".1", 1)
+	return nil
+}
+
+func TestWarning(t *testing.T) {
+	// Without Options.Warnings, the warnings are sent to errChan.
+	results, errs := RunInMemory([]string{"A"}, &mapperWarning{}, &ReducePassThrough{})
+	ut.AssertEqual(t, []KeyValue{{"A.1", 1}}, results)
+	ut.AssertEqual(t, 1, len(errs))
+	ut.AssertEqual(t, `warning for A: missing field "name"`, errs[0].Error())
+	var w *Warning
+	ut.AssertEqual(t, true, errors.As(errs[0], &w))
+	ut.AssertEqual(t, "A", w.Key)
+
+	errChan := make(chan error, 1)
+	warnings := make(chan error, 1)
+	out := make(chan KeyValue, 1)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A"}), out, errChan, nil, nil, &mapperWarning{}, &ReducePassThrough{}, &Options{Warnings: warnings, FailFast: true})
+	ut.AssertEqual(t, []KeyValue{{"A.1", 1}}, Collect(out))
+	ut.AssertEqual(t, 0, len(errChan))
+	ut.AssertEqual(t, `warning for A: missing field "name"`, (<-warnings).Error())
+}
+
+// mapperPanic panics for the map key "B" and emits (key.1, 1) otherwise.
+type mapperPanic struct {
+}
+
+func (m *mapperPanic) Map(io MapIO) error {
+	if io.MapKey() == "B" {
+		panic("Oh")
+	}
+	io.Emit(io.MapKey()+".1", 1)
+	return nil
+}
+
+// reducerPanic panics for every reduce key.
+type reducerPanic struct {
+}
+
+func (r *reducerPanic) Reduce(io ReduceIO) error {
+	panic(io.ReduceKey())
+}
+
+func TestRecoverPanics(t *testing.T) {
+	errChan := make(chan error, 1)
+	out := make(chan KeyValue, 2)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A", "B"}), out, errChan, nil, nil, &mapperPanic{}, &ReducePassThrough{}, &Options{RecoverPanics: true})
+	ut.AssertEqual(t, []KeyValue{{"A.1", 1}}, Collect(out))
+	err := (<-errChan).Error()
+	ut.AssertEqual(t, true, strings.HasPrefix(err, "failed to map B: panic: Oh\ngoroutine "))
+	ut.AssertEqual(t, true, strings.Contains(err, "mapperPanic"))
+}
+
+func TestPanicFormatter(t *testing.T) {
+	var stack []byte
+	opts := &Options{
+		RecoverPanics: true,
+		PanicFormatter: func(recovered interface{}, s []byte) error {
+			stack = s
+			return fmt.Errorf("recovered %v", recovered)
+		},
+	}
+	errChan := make(chan error, 1)
+	out := make(chan KeyValue, 1)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A"}), out, errChan, nil, nil, &mapperImpl{}, &reducerPanic{}, opts)
+	ut.AssertEqual(t, 0, len(Collect(out)))
+	ut.AssertEqual(t, "failed to reduce A.1: recovered A.1", (<-errChan).Error())
+	ut.AssertEqual(t, true, strings.Contains(string(stack), "reducerPanic"))
+}
@@ -0,0 +1,162 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// GeneratorFromSlice returns a generator that yields each item of keys in
+// order. The channel is closed once all the keys were read.
+//
+// The keys are buffered in the channel, so no goroutine is leaked when the
+// generator is not exhausted.
+func GeneratorFromSlice(keys []string) <-chan string {
+	out := make(chan string, len(keys))
+	for _, k := range keys {
+		out <- k
+	}
+	close(out)
+	return out
+}
+
+// GeneratorFromReader returns a generator that yields one key per line read
+// from r.
+//
+// Both LF and CRLF line endings are supported. Leading and trailing whitespace
+// is trimmed and blank lines are skipped. The channel is closed once r returns
+// io.EOF or any other error, or once ctx is done. Pass the context given to
+// MapReduceContext so the goroutine reading r exits when the run stops early.
+//
+// The returned function returns the error returned by r, if any other than
+// io.EOF. It must be called once the channel is closed.
+func GeneratorFromReader(ctx context.Context, r io.Reader) (<-chan string, func() error) {
+	out := make(chan string)
+	var err error
+	go func() {
+		defer close(out)
+		b := bufio.NewReader(r)
+		for {
+			line, e := b.ReadString('\n')
+			if k := strings.TrimSpace(line); k != "" {
+				select {
+				case out <- k:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if e != nil {
+				if e != io.EOF {
+					err = e
+				}
+				return
+			}
+		}
+	}()
+	return out, func() error { return err }
+}
+
+// DedupeGenerator returns a generator that yields the keys of in, skipping the
+// keys already yielded. The channel is closed once in is closed or once ctx is
+// done.
+//
+// Every unique key is kept in memory until in is closed, so the memory
+// overhead is the size of the keys plus a few dozen bytes per key for the
+// set.
+func DedupeGenerator(ctx context.Context, in <-chan string) <-chan string {
+	out := make(chan string)
+	go func() {
+		defer close(out)
+		seen := map[string]struct{}{}
+		for {
+			var k string
+			select {
+			case key, ok := <-in:
+				if !ok {
+					return
+				}
+				k = key
+			case <-ctx.Done():
+				return
+			}
+			if _, ok := seen[k]; ok {
+				continue
+			}
+			seen[k] = struct{}{}
+			select {
+			case out <- k:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// GeneratorFromDir returns a generator that yields the path of each file under
+// root whose base name matches pattern, as defined by filepath.Match, in
+// lexical order. An empty pattern matches all the files.
+//
+// Symlinks to files are yielded like files but symlinks to directories are
+// not followed, so a cycle can't make the walk loop forever. The files and
+// directories that can't be read, e.g. due to permissions, and the dangling
+// symlinks are skipped. An error is returned only if pattern is malformed or
+// root can't be read. The walk stops and the channel is closed once ctx is
+// done.
+//
+// The returned function returns the errors of the skipped entries, in walk
+// order. It must be called once the channel is closed.
+func GeneratorFromDir(ctx context.Context, root string, pattern string) (<-chan string, func() []error, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, nil, err
+	}
+	if _, err := os.Stat(root); err != nil {
+		return nil, nil, err
+	}
+	out := make(chan string)
+	var errs []error
+	go func() {
+		defer close(out)
+		_ = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				// Skip the unreadable entry and keep walking.
+				errs = append(errs, err)
+				return nil
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				if info, err = os.Stat(path); err != nil {
+					errs = append(errs, err)
+					return nil
+				}
+				if info.IsDir() {
+					return nil
+				}
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			if pattern != "" {
+				if ok, _ := filepath.Match(pattern, info.Name()); !ok {
+					return nil
+				}
+			}
+			select {
+			case out <- path:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+	return out, func() []error { return errs }, nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/maruel/ut"
+)
+
+func readAll(c <-chan string) []string {
+	out := []string{}
+	for i := range c {
+		out = append(out, i)
+	}
+	return out
+}
+
+func TestGeneratorFromSlice(t *testing.T) {
+	ut.AssertEqual(t, []string{"A", "B", "A"}, readAll(GeneratorFromSlice([]string{"A", "B", "A"})))
+	ut.AssertEqual(t, []string{}, readAll(GeneratorFromSlice(nil)))
+}
+
+func TestGeneratorFromReader(t *testing.T) {
+	data := []struct {
+		in       string
+		expected []string
+	}{
+		{"", []string{}},
+		{"A", []string{"A"}},
+		{"A\n", []string{"A"}},
+		{"A\nB", []string{"A", "B"}},
+		{"A\r\nB\r\n", []string{"A", "B"}},
+		{"A\r\n\r\n  \n\tB c \nC\r", []string{"A", "B c", "C"}},
+		{"\n\n\n", []string{}},
+	}
+	for i, line := range data {
+		keys, errFunc := GeneratorFromReader(context.Background(), strings.NewReader(line.in))
+		ut.AssertEqualIndex(t, i, line.expected, readAll(keys))
+		ut.AssertEqualIndex(t, i, nil, errFunc())
+	}
+}
+
+func TestGeneratorFromReaderError(t *testing.T) {
+	r := io.MultiReader(strings.NewReader("A\nB"), iotest.ErrReader(io.ErrUnexpectedEOF))
+	keys, errFunc := GeneratorFromReader(context.Background(), r)
+	ut.AssertEqual(t, []string{"A", "B"}, readAll(keys))
+	ut.AssertEqual(t, io.ErrUnexpectedEOF, errFunc())
+}
+
+// endlessReader yields "A\n" forever.
+type endlessReader struct{}
+
+func (endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = "A\n"[i%2]
+	}
+	return len(p) &^ 1, nil
+}
+
+func TestGeneratorFromReaderCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	keys, errFunc := GeneratorFromReader(ctx, endlessReader{})
+	ut.AssertEqual(t, "A", <-keys)
+	cancel()
+	// The channel is closed even though r is never exhausted.
+	readAll(keys)
+	ut.AssertEqual(t, nil, errFunc())
+}
+
+func TestDedupeGenerator(t *testing.T) {
+	in := GeneratorFromSlice([]string{"A", "B", "A", "C", "B", "A"})
+	ut.AssertEqual(t, []string{"A", "B", "C"}, readAll(DedupeGenerator(context.Background(), in)))
+
+	// The channel is closed once ctx is done even if in is never closed.
+	ctx, cancel := context.WithCancel(context.Background())
+	keys := DedupeGenerator(ctx, make(chan string))
+	cancel()
+	readAll(keys)
+}
+
+func TestGeneratorFromDir(t *testing.T) {
+	root := t.TempDir()
+	for _, p := range []string{"a.txt", "b.go", "sub/c.txt", "sub/d/e.txt"} {
+		p = filepath.Join(root, filepath.FromSlash(p))
+		ut.AssertEqual(t, nil, os.MkdirAll(filepath.Dir(p), 0o755))
+		ut.AssertEqual(t, nil, os.WriteFile(p, nil, 0o644))
+	}
+	// A symlink to a file is yielded, a symlink to a directory is not followed
+	// and a dangling symlink is skipped and reported.
+	ut.AssertEqual(t, nil, os.Symlink(filepath.Join(root, "a.txt"), filepath.Join(root, "link.txt")))
+	ut.AssertEqual(t, nil, os.Symlink(root, filepath.Join(root, "sub", "loop")))
+	ut.AssertEqual(t, nil, os.Symlink(filepath.Join(root, "missing"), filepath.Join(root, "dangling.txt")))
+
+	keys, errFunc, err := GeneratorFromDir(context.Background(), root, "*.txt")
+	ut.AssertEqual(t, nil, err)
+	expected := []string{"a.txt", "link.txt", "sub/c.txt", "sub/d/e.txt"}
+	for i, p := range expected {
+		expected[i] = filepath.Join(root, filepath.FromSlash(p))
+	}
+	ut.AssertEqual(t, expected, readAll(keys))
+	errs := errFunc()
+	ut.AssertEqual(t, 1, len(errs))
+	ut.AssertEqual(t, true, os.IsNotExist(errs[0]))
+
+	keys, _, err = GeneratorFromDir(context.Background(), root, "")
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 5, len(readAll(keys)))
+
+	// The walk stops once ctx is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	keys, errFunc, err = GeneratorFromDir(ctx, root, "")
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{}, readAll(keys))
+	ut.AssertEqual(t, 0, len(errFunc()))
+}
+
+func TestGeneratorFromDirError(t *testing.T) {
+	keys, errFunc, err := GeneratorFromDir(context.Background(), t.TempDir(), "[")
+	ut.AssertEqual(t, filepath.ErrBadPattern, err)
+	ut.AssertEqual(t, (<-chan string)(nil), keys)
+	ut.AssertEqual(t, true, errFunc == nil)
+	_, _, err = GeneratorFromDir(context.Background(), filepath.Join(t.TempDir(), "missing"), "")
+	ut.AssertEqual(t, true, os.IsNotExist(err))
+}
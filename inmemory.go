@@ -0,0 +1,113 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import (
+	"context"
+	"sort"
+)
+
+// RunAsync starts MapReduceContext in the background and returns its outputs
+// and errors. Both channels are closed once the run completes, so they can be
+// read with a range loop.
+//
+// The channels are not buffered and MapReduce blocks on sending to either, so
+// they must be read concurrently, or ctx cancelled. Unlike MapReduceContext,
+// the cancellation of ctx is not reported.
+func RunAsync(ctx context.Context, generator <-chan string, cache *MappingCache, perf *PerfStats, mapper Mapper, reducer Reducer, opts *Options) (<-chan KeyValue, <-chan error) {
+	out := make(chan KeyValue)
+	errs := make(chan error)
+	go func() {
+		defer close(errs)
+		MapReduceContext(ctx, generator, out, errs, cache, perf, mapper, reducer, opts)
+	}()
+	return out, errs
+}
+
+// RunInMemory runs a complete map reduce over keys without cache and returns
+// all the outputs and errors once done.
+//
+// It takes care of all the channel plumbing so it is mostly useful to unit
+// test a Mapper or a Reducer. The order of the results and of the errors is
+// not deterministic.
+func RunInMemory(keys []string, mapper Mapper, reducer Reducer) ([]KeyValue, []error) {
+	return runInMemory(keys, mapper, reducer, nil)
+}
+
+// RunReduceOnly runs reducer over groups, a map of reduce key to its values,
+// skipping the map phase, and returns all the outputs and errors once done.
+//
+// Each reducer receives the values of its reduce key in order. It is mostly
+// useful to unit test a Reducer. Like for a full run, a reducer is not started
+// for a reduce key without values, and the order of the results and of the
+// errors is not deterministic.
+func RunReduceOnly(groups map[string][]interface{}, reducer Reducer) ([]KeyValue, []error) {
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return runInMemory(keys, groupsMapper(groups), reducer, &Options{OrderedValues: true})
+}
+
+// groupsMapper emits the values of the map key to the reduce key of the same
+// name, for RunReduceOnly.
+type groupsMapper map[string][]interface{}
+
+func (g groupsMapper) Map(io MapIO) error {
+	k := io.MapKey()
+	kvs := make([]KeyValue, 0, len(g[k]))
+	for _, v := range g[k] {
+		kvs = append(kvs, KeyValue{k, v})
+	}
+	io.EmitBatch(kvs)
+	return nil
+}
+
+// Simple runs a complete map reduce over keys without cache and returns the
+// outputs as a map of final key to final value, along with the errors, once
+// done. It is the convenience entry point for small jobs whose outputs fit in
+// memory.
+//
+// A final key output more than once is reported as an error and only one of
+// its values, not deterministically chosen, is kept. Use RunInMemory to get
+// all the outputs.
+func Simple(keys []string, mapper Mapper, reducer Reducer) (map[string]interface{}, []error) {
+	results, errs := runInMemory(keys, mapper, reducer, &Options{DetectDuplicateOutput: true})
+	m := make(map[string]interface{}, len(results))
+	for _, kv := range results {
+		m[kv.Key] = kv.Value
+	}
+	return m, errs
+}
+
+// runInMemory is RunInMemory with opts.
+func runInMemory(keys []string, mapper Mapper, reducer Reducer, opts *Options) ([]KeyValue, []error) {
+	out, errChan := RunAsync(context.Background(), GeneratorFromSlice(keys), nil, nil, mapper, reducer, opts)
+	var errs []error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for err := range errChan {
+			errs = append(errs, err)
+		}
+	}()
+
+	results := Collect(out)
+	<-done
+	return results, errs
+}
+
+// Collect reads out until it is closed and returns all the items read.
+//
+// Since MapReduce blocks on sending to out, Collect must run concurrently with
+// MapReduce, unless out is buffered large enough to hold all the results.
+func Collect(out <-chan KeyValue) []KeyValue {
+	var results []KeyValue
+	for i := range out {
+		results = append(results, i)
+	}
+	return results
+}
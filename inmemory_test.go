@@ -0,0 +1,95 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func TestRunInMemory(t *testing.T) {
+	results, errs := RunInMemory([]string{"A", "B"}, &mapperMulti{}, &reducerTotal{})
+	sort.Slice(results, func(i, j int) bool { return results[i].Key < results[j].Key })
+	ut.AssertEqual(t, []KeyValue{{"A", 6}, {"B", 6}, {"all", 20}}, results)
+	ut.AssertEqual(t, 0, len(errs))
+}
+
+func TestRunInMemoryError(t *testing.T) {
+	results, errs := RunInMemory([]string{"A"}, &mapperImpl{err: errors.New("Oh")}, &ReducePassThrough{})
+	ut.AssertEqual(t, 0, len(results))
+	ut.AssertEqual(t, 1, len(errs))
+	ut.AssertEqual(t, "failed to map A: Oh", errs[0].Error())
+}
+
+func TestRunReduceOnly(t *testing.T) {
+	groups := map[string][]interface{}{"a": {1, 2, 3}, "b": {4}, "empty": {}}
+	results, errs := RunReduceOnly(groups, &reducerTotal{})
+	sort.Slice(results, func(i, j int) bool { return results[i].Key < results[j].Key })
+	ut.AssertEqual(t, []KeyValue{{"a", 6}, {"b", 4}}, results)
+	ut.AssertEqual(t, 0, len(errs))
+
+	// The values are received in order.
+	results, errs = RunReduceOnly(map[string][]interface{}{"k": {"x", "y", "z"}}, &reducerJoin{})
+	ut.AssertEqual(t, []KeyValue{{"k", "x,y,z"}}, results)
+	ut.AssertEqual(t, 0, len(errs))
+
+	results, errs = RunReduceOnly(groups, &reducerFailing{errors.New("Oh")})
+	ut.AssertEqual(t, 0, len(results))
+	actual := []string{}
+	for _, err := range SortErrors(errs) {
+		actual = append(actual, err.Error())
+	}
+	ut.AssertEqual(t, []string{"failed to reduce a: Oh", "failed to reduce b: Oh"}, actual)
+}
+
+func TestSimple(t *testing.T) {
+	results, errs := Simple([]string{"A", "B"}, &mapperMulti{}, &reducerTotal{})
+	ut.AssertEqual(t, map[string]interface{}{"A": 6, "B": 6, "all": 20}, results)
+	ut.AssertEqual(t, 0, len(errs))
+}
+
+func TestSimpleDuplicate(t *testing.T) {
+	results, errs := Simple([]string{"A", "B"}, &mapperImpl{}, &reducerConstant{})
+	ut.AssertEqual(t, 1, len(results))
+	ut.AssertEqual(t, 1, len(errs))
+	ut.AssertEqual(t, "final key constant was output more than once", errs[0].Error())
+}
+
+func TestRunAsync(t *testing.T) {
+	mapper := mapperFailing{"B": errors.New("Oh")}
+	out, errs := RunAsync(context.Background(), GeneratorFromSlice([]string{"A", "B"}), nil, nil, mapper, &ReducePassThrough{}, nil)
+	var actual []string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for err := range errs {
+			actual = append(actual, err.Error())
+		}
+	}()
+	ut.AssertEqual(t, []KeyValue{{"A.1", 1}}, Collect(out))
+	<-done
+	ut.AssertEqual(t, []string{"failed to map B: Oh"}, actual)
+}
+
+func ExampleCollect() {
+	out := make(chan KeyValue)
+	// MapReduce blocks until out is fully read, so it must run in its own
+	// goroutine. The generator is fed concurrently by GeneratorFromSlice.
+	go MapReduce(GeneratorFromSlice([]string{"A", "B"}), out, nil, nil, nil, &mapperMulti{}, &reducerTotal{})
+	results := Collect(out)
+	sort.Slice(results, func(i, j int) bool { return results[i].Key < results[j].Key })
+	for _, i := range results {
+		fmt.Printf("%s: %d\n", i.Key, i.Value)
+	}
+	// Output:
+	// A: 6
+	// B: 6
+	// all: 20
+}
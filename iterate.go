@@ -0,0 +1,57 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import (
+	"context"
+)
+
+// Iterate runs up to rounds map reduce passes, as needed by iterative
+// algorithms.
+//
+// The first round maps keys. Each following round maps the unique final keys
+// output by the previous round, in output order. After each round, converged
+// is called with the round number, starting at 0, and the round's results; it
+// returns true to stop early. converged may be nil. The iteration also stops
+// when a round outputs nothing.
+//
+// cache is shared by all the rounds, so a map key mapped in a previous round
+// is replayed from the cache. Only use a cache when the mapping of a key
+// doesn't depend on the round.
+//
+// It returns the results of the last round run and the error returned by
+// MapReduceContext, if any.
+func Iterate(ctx context.Context, rounds int, keys []string, errChan chan<- error, cache *MappingCache, perf *PerfStats, mapper Mapper, reducer Reducer, opts *Options, converged func(round int, results []KeyValue) bool) ([]KeyValue, error) {
+	var results []KeyValue
+	for round := 0; round < rounds && len(keys) != 0; round++ {
+		out := make(chan KeyValue)
+		done := make(chan error)
+		go func(keys []string) {
+			done <- MapReduceContext(ctx, GeneratorFromSlice(keys), out, errChan, cache, perf, mapper, reducer, opts)
+		}(keys)
+		results = Collect(out)
+		if err := <-done; err != nil {
+			return results, err
+		}
+		if converged != nil && converged(round, results) {
+			break
+		}
+		keys = uniqueKeys(results)
+	}
+	return results, nil
+}
+
+// uniqueKeys returns the keys of kvs, without duplicates, in order.
+func uniqueKeys(kvs []KeyValue) []string {
+	seen := make(map[string]struct{}, len(kvs))
+	keys := make([]string, 0, len(kvs))
+	for _, kv := range kvs {
+		if _, ok := seen[kv.Key]; !ok {
+			seen[kv.Key] = struct{}{}
+			keys = append(keys, kv.Key)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,55 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+// mapperHalve emits half of the map key, until 1.
+type mapperHalve struct {
+}
+
+func (m *mapperHalve) Map(io MapIO) error {
+	i, err := strconv.Atoi(io.MapKey())
+	if err != nil {
+		return err
+	}
+	if i > 1 {
+		io.Emit(strconv.Itoa(i/2), i)
+	}
+	return nil
+}
+
+func TestIterate(t *testing.T) {
+	rounds := []int{}
+	converged := func(round int, results []KeyValue) bool {
+		rounds = append(rounds, round)
+		return false
+	}
+	results, err := Iterate(context.Background(), 10, []string{"16", "17"}, nil, nil, nil, &mapperHalve{}, &ReducePassThrough{}, nil, converged)
+	ut.AssertEqual(t, nil, err)
+	// 16,17 -> 8 -> 4 -> 2 -> 1 -> nothing.
+	ut.AssertEqual(t, []int{0, 1, 2, 3, 4}, rounds)
+	ut.AssertEqual(t, 0, len(results))
+}
+
+func TestIterateConverged(t *testing.T) {
+	converged := func(round int, results []KeyValue) bool {
+		return len(results) == 1 && results[0].Key == "2"
+	}
+	results, err := Iterate(context.Background(), 10, []string{"16"}, nil, nil, nil, &mapperHalve{}, &ReducePassThrough{}, nil, converged)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []KeyValue{{"2", 4}}, results)
+
+	// Limited by rounds.
+	results, err = Iterate(context.Background(), 1, []string{"16"}, nil, nil, nil, &mapperHalve{}, &ReducePassThrough{}, nil, nil)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []KeyValue{{"8", 16}}, results)
+}
@@ -0,0 +1,83 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter gates the mapper calls, as set in Options.RateLimiter.
+//
+// *rate.Limiter from golang.org/x/time/rate implements it.
+type Limiter interface {
+	// Wait blocks until the next call is allowed. It returns an error if ctx
+	// is cancelled first.
+	Wait(ctx context.Context) error
+}
+
+// NewLimiter returns a Limiter allowing n calls per duration, spaced evenly.
+// It doesn't limit the calls if n or per is not positive.
+//
+// Used as Options.RateLimiter, the time is read from Options.Clock.
+func NewLimiter(n int, per time.Duration) Limiter {
+	return newSpacer(n, per)
+}
+
+// spacer spaces events evenly.
+type spacer struct {
+	interval time.Duration
+
+	lock sync.Mutex
+	next time.Time // Time of the next allowed event.
+}
+
+func newSpacer(n int, per time.Duration) *spacer {
+	if n <= 0 || per <= 0 {
+		return &spacer{}
+	}
+	return &spacer{interval: per / time.Duration(n)}
+}
+
+// reserve reserves the next slot and returns how long to wait for it.
+func (s *spacer) reserve(clock Clock) time.Duration {
+	if s.interval == 0 {
+		return 0
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := clock.Now()
+	if s.next.Before(now) {
+		s.next = now
+	}
+	wait := s.next.Sub(now)
+	s.next = s.next.Add(s.interval)
+	return wait
+}
+
+// Wait implements Limiter.
+//
+// A slot reserved by a cancelled call is not given back, so the following
+// calls are still spaced evenly.
+func (s *spacer) Wait(ctx context.Context) error {
+	return s.wait(ctx, systemClock{})
+}
+
+// wait is Wait with the time read from clock.
+func (s *spacer) wait(ctx context.Context, clock Clock) error {
+	wait := s.reserve(clock)
+	if wait <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
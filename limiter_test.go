@@ -0,0 +1,56 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/maruel/ut"
+)
+
+func TestNewLimiter(t *testing.T) {
+	l := NewLimiter(2, 100*time.Millisecond)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		ut.AssertEqual(t, nil, l.Wait(context.Background()))
+	}
+	ut.AssertEqual(t, true, time.Since(start) >= 100*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ut.AssertEqual(t, context.Canceled, l.Wait(ctx))
+
+	// Not limited.
+	for _, l := range []Limiter{NewLimiter(0, time.Hour), NewLimiter(-1, time.Hour), NewLimiter(1, 0)} {
+		ut.AssertEqual(t, nil, l.Wait(context.Background()))
+		ut.AssertEqual(t, nil, l.Wait(context.Background()))
+	}
+}
+
+func TestMapReduceRateLimiterClock(t *testing.T) {
+	// The fake clock advances by an hour every time it is read, so the mappers
+	// never wait.
+	opts := &Options{RateLimiter: NewLimiter(1, time.Hour), Clock: &fakeClock{step: time.Hour}}
+	out := make(chan KeyValue, 3)
+	ut.AssertEqual(t, nil, MapReduceContext(context.Background(), GeneratorFromSlice([]string{"A", "B", "C"}), out, nil, nil, nil, &mapperImpl{}, &ReducePassThrough{}, opts))
+	ut.AssertEqual(t, 3, len(Collect(out)))
+}
+
+func TestMapReduceRateLimiter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	out := make(chan KeyValue)
+	done := make(chan error)
+	go func() {
+		opts := &Options{RateLimiter: NewLimiter(1, time.Hour)}
+		done <- MapReduceContext(ctx, GeneratorFromSlice([]string{"A", "B"}), out, nil, nil, nil, &mapperImpl{}, &ReducePassThrough{}, opts)
+	}()
+	// The second mapper waits for an hour, unless cancelled.
+	kv := <-out
+	ut.AssertEqual(t, 1, kv.Value)
+	cancel()
+	ut.AssertEqual(t, context.Canceled, <-done)
+}
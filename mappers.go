@@ -0,0 +1,81 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import "time"
+
+// MapperFunc adapts an ordinary function into a Mapper.
+type MapperFunc func(io MapIO) error
+
+// Map implements Mapper by calling f(io).
+func (f MapperFunc) Map(io MapIO) error {
+	return f(io)
+}
+
+// BatchMapper is an alternative to Mapper for mappers that compute all their
+// outputs at once. Use MapperFromBatch to pass it to MapReduce.
+type BatchMapper interface {
+	// MapBatch returns the KeyValue to emit for mapKey. They are emitted even
+	// if an error is returned.
+	MapBatch(mapKey string) ([]KeyValue, error)
+}
+
+// MapperFromBatch adapts a BatchMapper into a Mapper. The returned KeyValue
+// are emitted with a single EmitBatch call, so they are cached and replayed
+// exactly like values emitted by a Mapper.
+func MapperFromBatch(m BatchMapper) Mapper {
+	return &batchMapper{m}
+}
+
+type batchMapper struct {
+	m BatchMapper
+}
+
+func (b *batchMapper) Map(io MapIO) error {
+	kvs, err := b.m.MapBatch(io.MapKey())
+	if len(kvs) != 0 {
+		io.EmitBatch(kvs)
+	}
+	return err
+}
+
+// Chain wraps m with the middlewares. The first middleware is the outermost
+// one, so Chain(m, a, b) is a(b(m)).
+func Chain(m Mapper, middlewares ...func(Mapper) Mapper) Mapper {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		m = middlewares[i](m)
+	}
+	return m
+}
+
+// RateLimit returns a middleware that limits the calls to Map to n per
+// duration, across all the mappers running concurrently. The calls are spaced
+// evenly instead of bursting, e.g. to be polite to a remote server. It doesn't
+// limit the calls if n or per is not positive.
+//
+// The wait is interrupted once the context of MapIO is done, in which case the
+// error of the context is returned without calling Map. The time is read from
+// Options.Clock.
+func RateLimit(n int, per time.Duration) func(Mapper) Mapper {
+	return func(m Mapper) Mapper {
+		return &rateLimited{m: m, s: newSpacer(n, per)}
+	}
+}
+
+type rateLimited struct {
+	m Mapper
+	s *spacer
+}
+
+func (r *rateLimited) Map(io MapIO) error {
+	var clock Clock = systemClock{}
+	if m, ok := io.(*mapIO); ok {
+		clock = m.j.clock
+	}
+	if err := r.s.wait(io.Context(), clock); err != nil {
+		return err
+	}
+	return r.m.Map(io)
+}
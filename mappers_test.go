@@ -0,0 +1,110 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maruel/ut"
+)
+
+// mapperSplit returns one KeyValue per letter of the map key.
+type mapperSplit struct {
+}
+
+func (m *mapperSplit) MapBatch(mapKey string) ([]KeyValue, error) {
+	if mapKey == "" {
+		return nil, errors.New("empty")
+	}
+	var kvs []KeyValue
+	for _, c := range mapKey {
+		kvs = append(kvs, KeyValue{string(c), 1})
+	}
+	return kvs, nil
+}
+
+func TestMapperFromBatch(t *testing.T) {
+	results, errs := RunInMemory([]string{"ab", "bc", ""}, MapperFromBatch(&mapperSplit{}), &reducerTotal{})
+	sort.Slice(results, func(i, j int) bool { return results[i].Key < results[j].Key })
+	ut.AssertEqual(t, []KeyValue{{"a", 1}, {"b", 2}, {"c", 1}}, results)
+	ut.AssertEqual(t, 1, len(errs))
+	ut.AssertEqual(t, "failed to map : empty", errs[0].Error())
+}
+
+func TestMapperFunc(t *testing.T) {
+	var lock sync.Mutex
+	seen := map[string]bool{}
+	mapper := MapperFunc(func(io MapIO) error {
+		lock.Lock()
+		seen[io.MapKey()] = true
+		lock.Unlock()
+		io.Emit("k", 1)
+		return nil
+	})
+	results, errs := RunInMemory([]string{"A", "B"}, mapper, &ReduceCount{})
+	ut.AssertEqual(t, []KeyValue{{"k", 2}}, results)
+	ut.AssertEqual(t, 0, len(errs))
+	ut.AssertEqual(t, map[string]bool{"A": true, "B": true}, seen)
+}
+
+// recordMiddleware returns a middleware appending name to calls before each
+// Map call.
+func recordMiddleware(name string, lock *sync.Mutex, calls *[]string) func(Mapper) Mapper {
+	return func(m Mapper) Mapper {
+		return MapperFunc(func(io MapIO) error {
+			lock.Lock()
+			*calls = append(*calls, name)
+			lock.Unlock()
+			return m.Map(io)
+		})
+	}
+}
+
+func TestChain(t *testing.T) {
+	var lock sync.Mutex
+	var calls []string
+	mapper := Chain(&mapperImpl{}, recordMiddleware("a", &lock, &calls), recordMiddleware("b", &lock, &calls))
+	results, errs := RunInMemory([]string{"A"}, mapper, &ReducePassThrough{})
+	ut.AssertEqual(t, []KeyValue{{"A.1", 1}}, results)
+	ut.AssertEqual(t, 0, len(errs))
+	ut.AssertEqual(t, []string{"a", "b"}, calls)
+}
+
+func TestRateLimit(t *testing.T) {
+	start := time.Now()
+	mapper := Chain(&mapperImpl{}, RateLimit(2, 100*time.Millisecond))
+	results, errs := RunInMemory([]string{"A", "B", "C", "D"}, mapper, &ReducePassThrough{})
+	// The calls are spaced by 50ms, the first one being immediate.
+	ut.AssertEqual(t, true, time.Since(start) >= 150*time.Millisecond)
+	ut.AssertEqual(t, 4, len(results))
+	ut.AssertEqual(t, 0, len(errs))
+
+	// The fake clock advances by an hour every time it is read, so the calls
+	// never wait.
+	mapper = Chain(&mapperImpl{}, RateLimit(1, time.Hour))
+	out := make(chan KeyValue, 3)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A", "B", "C"}), out, nil, nil, nil, mapper, &ReducePassThrough{}, &Options{Clock: &fakeClock{step: time.Hour}})
+	ut.AssertEqual(t, 3, len(Collect(out)))
+}
+
+func TestRateLimitCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	mapper := Chain(&mapperImpl{}, RateLimit(1, time.Hour))
+	out := make(chan KeyValue)
+	errChan := make(chan error, 1)
+	done := make(chan error)
+	go func() {
+		done <- MapReduceContext(ctx, GeneratorFromSlice([]string{"A", "B"}), out, errChan, nil, nil, mapper, &ReducePassThrough{}, &Options{MaxMappers: 1})
+	}()
+	// The second call waits for an hour, unless cancelled.
+	ut.AssertEqual(t, KeyValue{"A.1", 1}, <-out)
+	cancel()
+	ut.AssertEqual(t, context.Canceled, <-done)
+}
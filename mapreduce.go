@@ -11,26 +11,79 @@
 package mapreduce
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
+	"errors"
 	"fmt"
 	"reflect"
+	"runtime/debug"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // Public API.
 
 // MapIO is the argument to the mapper.
+//
+// Keys are plain Go strings so they may hold arbitrary bytes, including NUL
+// and invalid UTF-8 sequences. They are kept as-is in MappingCache, including
+// through a gob round trip.
 type MapIO interface {
 	MapKey() string
+	// MapKeyBytes returns MapKey() as a byte slice. The slice is a copy so it is
+	// safe to modify.
+	MapKeyBytes() []byte
+	// Emit sends reduceValue to the reducer of reduceKey.
+	//
+	// It may be called any number of times, including multiple times with the
+	// same reduceKey; each call is a separate value for the reducer. With a
+	// MappingCache, all the values are cached in Emit() call order and
+	// replayed in the same order on a cache hit.
+	//
+	// reduceValue may be nil, or a nil pointer. It is then received as-is by
+	// the reducer and MappingCache replays it as the same nil value, without
+	// checking its type in the case of a plain nil.
 	Emit(reduceKey string, reduceValue interface{})
+	// EmitBatch is the equivalent of calling Emit for each item of kvs, with a
+	// single cache lock acquisition to check the types and store the values. It is meant for mappers emitting a lot of
+	// values per key.
+	EmitBatch(kvs []KeyValue)
+	// Context returns the context of the mapper call. It carries the values of
+	// the context passed to MapReduceContext, e.g. run-scoped configuration
+	// like an auth token shared by all the map keys, and is done once the run
+	// is stopped or Options.MapperTimeout expired.
+	Context() context.Context
+	// Warn reports a non-fatal problem with the map key, e.g. a missing field
+	// in otherwise usable data, as a *Warning. Unlike an error returned by
+	// Map, it doesn't drop the values emitted. It is sent to
+	// Options.Warnings, or to errChan if not set.
+	Warn(format string, args ...interface{})
 }
 
 // ReduceIO is the argument to the reducer.
 type ReduceIO interface {
 	ReduceKey() string
+	// ReduceValues returns the values emitted for ReduceKey(). The channel is
+	// closed once every value for this key has been delivered, so a reducer can
+	// run its finalization step right after ranging over it. A reducer is only
+	// started for a key that was emitted at least once, so the channel always
+	// yields at least one value before being closed.
+	//
+	// When the run is cancelled, the channel is closed early even though values
+	// may be missing; use Cancelled() to tell both cases apart.
 	ReduceValues() <-chan interface{}
+	// NumValues returns the number of values emitted for ReduceKey() so far.
+	// Since the reducer is started as soon as the first value is emitted, it is
+	// a lower bound until ReduceValues() is closed, at which point it is exact.
+	// It is meant as a hint to pre-allocate buffers.
+	NumValues() int
+	// Cancelled returns true once the run is cancelled. Outputs are then
+	// discarded.
+	Cancelled() bool
+	// Output sends a final KeyValue to out. Outputs made sequentially by a
+	// reducer are received from out in call order, but may be interleaved with
+	// the outputs of other reducers unless Options.ContiguousOutput is set.
 	Output(finalKey string, finalValue interface{})
 }
 
@@ -40,22 +93,22 @@ type Mapper interface {
 }
 
 // Reducer is what reduces data from what was generated by the Mapper.
+//
+// Reduce is called once per reduce key. Output may be called any number of
+// times, including after ReduceValues() is exhausted, until Reduce returns.
 type Reducer interface {
 	Reduce(r ReduceIO) error
 }
 
-// MappingCache caches all the data. It is serializable.
-type MappingCache struct {
-	lock      sync.Mutex
-	valueType reflect.Type // Do not export so it is not serialized; reflect.Type can't be serialized.
-	Data      map[string]*cacheValues
-}
-
-// SetValueType must be called before usage.
-func (c *MappingCache) SetValueType(value interface{}) {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-	c.valueType = reflect.TypeOf(value)
+// Combiner merges the values emitted for a reduce key by a single mapper call,
+// before they are cached and sent to the reducer, e.g. to pre-aggregate word
+// counts. Set it as Options.Combiner.
+//
+// The reducer then receives one combined value per mapper call that emitted
+// for the reduce key, so the combined value must be a valid input for both
+// the reducer and the Combiner.
+type Combiner interface {
+	Combine(reduceKey string, values []interface{}) (interface{}, error)
 }
 
 // KeyValue is a key-value pair.
@@ -64,6 +117,22 @@ type KeyValue struct {
 	Value interface{}
 }
 
+// SourcedValue is the value sent to out with Options.AnnotateSource.
+type SourcedValue struct {
+	Value interface{}
+	// FromCache is true if none of the values emitted for the reduce key were
+	// computed by a mapper in this run, i.e. they were all replayed from the
+	// MappingCache.
+	FromCache bool
+}
+
+// FinalGroup is all the values output for a final key, as sent to
+// Options.GroupedOut.
+type FinalGroup struct {
+	Key    string
+	Values []interface{}
+}
+
 // PerfStats stores the performance statistics of mapreduce execution and the
 // cache hit and miss rate.
 type PerfStats struct {
@@ -71,6 +140,10 @@ type PerfStats struct {
 	reducersRunning int64
 	cacheHits       int64
 	cacheMisses     int64
+	outputBlocked   int64 // In nanoseconds.
+	maxValuesPerKey int64
+	reduceKeys      int64
+	seedsInFlight   int64
 }
 
 // MappersRunning returns the number of mappers currently running.
@@ -95,87 +168,853 @@ func (p *PerfStats) CacheMisses() int {
 	return int(atomic.LoadInt64(&p.cacheMisses))
 }
 
+// CacheHitRatio returns CacheHits() / (CacheHits() + CacheMisses()), or 0 when
+// no map key was processed yet.
+//
+// Each counter is read atomically but not both at once, so while a MapReduce
+// is running the ratio may be off by the map keys processed in between.
+func (p *PerfStats) CacheHitRatio() float64 {
+	hits := atomic.LoadInt64(&p.cacheHits)
+	misses := atomic.LoadInt64(&p.cacheMisses)
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// OutputBlockedDuration returns the cumulative time reducers spent blocked
+// sending to out. A large value relative to the run time means the consumer of
+// out is the bottleneck.
+func (p *PerfStats) OutputBlockedDuration() time.Duration {
+	return time.Duration(atomic.LoadInt64(&p.outputBlocked))
+}
+
+// MaxValuesPerKey returns the largest number of values received by a single
+// reduce key. Compared to the average, it shows the skew of the reduce keys.
+func (p *PerfStats) MaxValuesPerKey() int {
+	return int(atomic.LoadInt64(&p.maxValuesPerKey))
+}
+
+// DistinctReduceKeys returns the number of reduce keys seen, which is the
+// number of reducers started.
+func (p *PerfStats) DistinctReduceKeys() int {
+	return int(atomic.LoadInt64(&p.reduceKeys))
+}
+
+// SeedsInFlight returns the number of values currently being sent to a
+// reducer that didn't receive them yet. Without Options.FeederWorkers, it is
+// also the number of goroutines blocked sending them.
+func (p *PerfStats) SeedsInFlight() int {
+	return int(atomic.LoadInt64(&p.seedsInFlight))
+}
+
+// addReduceValue records that a reduce key now has numValues values.
+func (p *PerfStats) addReduceValue(numValues int64) {
+	if numValues == 1 {
+		atomic.AddInt64(&p.reduceKeys, 1)
+	}
+	for {
+		max := atomic.LoadInt64(&p.maxValuesPerKey)
+		if numValues <= max || atomic.CompareAndSwapInt64(&p.maxValuesPerKey, max, numValues) {
+			return
+		}
+	}
+}
+
+// Stats is a snapshot of PerfStats.
+type Stats struct {
+	MappersRunning        int
+	ReducersRunning       int
+	CacheHits             int
+	CacheMisses           int
+	OutputBlockedDuration time.Duration
+	MaxValuesPerKey       int
+	DistinctReduceKeys    int
+	SeedsInFlight         int
+}
+
+// Snapshot returns the current value of all the counters.
+//
+// It is safe to call concurrently with a running MapReduce, e.g. to
+// periodically report progress. Each counter is read atomically but the
+// counters are not read as a single transaction.
+func (p *PerfStats) Snapshot() Stats {
+	return Stats{
+		MappersRunning:        p.MappersRunning(),
+		ReducersRunning:       p.ReducersRunning(),
+		CacheHits:             p.CacheHits(),
+		CacheMisses:           p.CacheMisses(),
+		OutputBlockedDuration: p.OutputBlockedDuration(),
+		MaxValuesPerKey:       p.MaxValuesPerKey(),
+		DistinctReduceKeys:    p.DistinctReduceKeys(),
+		SeedsInFlight:         p.SeedsInFlight(),
+	}
+}
+
+// Clock returns the current time.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the default Clock.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Options tunes the behavior of MapReduceWithOptions. The zero value matches
+// the behavior of MapReduce.
+type Options struct {
+	// OrderedValues guarantees that ReduceValues() yields the values for a
+	// reduce key in the order they were emitted. Values emitted by a single
+	// mapper are then received in Emit() call order. It costs throughput since
+	// values for a key are fed serially instead of concurrently.
+	OrderedValues bool
+	// MaxOutput stops the run once this many KeyValue were sent to out. The
+	// remaining mappers and reducers are cancelled; mappers already running
+	// are waited for but their emissions are discarded. With GroupedOut or
+	// MergeOutput, it instead limits the number of groups or merged KeyValues
+	// sent once the reducers are done. 0 means unlimited.
+	MaxOutput int
+	// DetectDuplicateOutput sends an error to errChan every time a reducer
+	// outputs a final key that was already output. It is a diagnostic aid for
+	// reducers that unintentionally clobber each other's final keys.
+	DetectDuplicateOutput bool
+	// PanicOnError panics on the first error when errChan is nil, instead of
+	// silently discarding errors. It is meant for quick one-off scripts.
+	PanicOnError bool
+	// RecoverPanics converts a panic in Map or Reduce into an error, reported
+	// as a MapError or a ReduceError, instead of crashing the process. The
+	// error is built by PanicFormatter.
+	RecoverPanics bool
+	// PanicFormatter, if set, builds the error reported for a panic recovered
+	// with RecoverPanics from the recovered value and the stack of the
+	// panicking goroutine, e.g. to strip sensitive data. By default the error
+	// is "panic: <recovered>" followed by the stack on the next lines.
+	PanicFormatter func(recovered interface{}, stack []byte) error
+	// GroupKeyFunc, if set, computes the grouping bucket of each emitted reduce
+	// key. Values emitted with different reduce keys that map to the same
+	// bucket are sent to the same reducer, e.g. strings.ToLower for case
+	// insensitive grouping or unicode normalization. ReduceIO.ReduceKey() then
+	// returns the bucket, not the emitted reduce key. It applies to both
+	// concurrent and serial reduction.
+	//
+	// There is no separate partitioning step: one reducer is started per
+	// bucket. A mapper that already computed the bucket of a value can emit the
+	// bucket directly as the reduce key, mixed with regular Emit calls, as long
+	// as GroupKeyFunc returns a bucket unchanged, as strings.ToLower does.
+	GroupKeyFunc func(reduceKey string) string
+	// FailFast stops the run on the first error, after sending it to errChan.
+	// The remaining mappers and reducers are cancelled, like with MaxOutput,
+	// and MapReduceContext returns the error. The outputs received from out
+	// before the abort are valid partial results; outputs not yet sent are
+	// dropped. By default the run continues on error.
+	FailFast bool
+	// IsFatal, if set, classifies the errors: an error for which it returns
+	// true stops the run like with FailFast, while the others are only sent to
+	// errChan. The errors are wrapped, e.g. a TypeMismatchError is sent as a
+	// MapError, so use errors.As to inspect them. It is redundant with
+	// FailFast, which treats every error as fatal.
+	IsFatal func(err error) bool
+	// MaxErrors stops the run once more than this many errors were sent to
+	// errChan, e.g. when a remote site is down. Like with FailFast, the
+	// remaining mappers and reducers are cancelled; MapReduceContext returns
+	// an error wrapping the last one. Warnings don't count. 0 means unlimited.
+	MaxErrors int
+	// AnnotateSource wraps each value sent to out in a SourcedValue telling
+	// whether it was computed only from values replayed from the cache, e.g.
+	// to audit the freshness of each result. The values emitted so far for
+	// the reduce key are considered, so an output is conservatively not from
+	// the cache as soon as a fresh value was emitted, even if not yet
+	// received by the reducer. With ReduceStages, an output is from the cache
+	// only if no mapper ran. The other output options see the plain values.
+	AnnotateSource bool
+	// MaxMappers limits the number of mappers running concurrently. 0 means
+	// unlimited.
+	MaxMappers int
+	// SerialReduce runs the reducers one at a time, in reduce key order, in a
+	// single goroutine once all the values were emitted and grouped. It
+	// trades throughput for determinism and simpler debugging of reducers that
+	// share mutable state.
+	SerialReduce bool
+	// MaxBufferedValues limits the number of emitted values waiting to be
+	// received by their reducer. Once reached, the mappers block on Emit until
+	// the reducers catch up. It bounds memory usage at the cost of throughput.
+	// 0 means unlimited. It is ignored with SerialReduce, which needs to buffer
+	// all the values.
+	MaxBufferedValues int
+	// PhasedExecution waits for all the mappers to complete before starting
+	// the reducers, instead of streaming the values to the reducers as they
+	// are emitted. All the emitted values are held in memory in the meantime.
+	// It gives a clean separation of the phases, e.g. for benchmarking.
+	// SerialReduce implies it.
+	PhasedExecution bool
+	// MaxReducers limits the number of reducers running concurrently. 0 means
+	// unlimited. A reducer runs until all the values were emitted, so the
+	// values of the reduce keys waiting for a reducer are held in memory;
+	// MaxBufferedValues and FeederWorkers are ignored.
+	MaxReducers int
+	// ReduceParallelismPerKey, if greater than 1, splits the values of each
+	// reduce key across up to this many concurrent partial reducers, started
+	// as the existing ones fall behind, then runs the reducer once more over
+	// the values output by the partial reducers to produce the final outputs.
+	// It relieves a hot reduce key with a lot of values.
+	//
+	// The reducer must be associative: reducing the outputs of reducers run
+	// over any split of the values must give the same result as reducing all
+	// the values, as with ReduceSum but not ReduceCount. The final keys output
+	// by the partial reducers are ignored. It is ignored with SerialReduce,
+	// Deterministic and ReduceCache.
+	ReduceParallelismPerKey int
+	// ReduceStages, if set, are reducers run in sequence after the reducer,
+	// e.g. to sum then normalize. The outputs of each reducer are regrouped by
+	// final key: each final key becomes a reduce key of the next stage and
+	// the final values output for it become its values. A stage starts once
+	// the previous one is done. Only the outputs of the last stage are sent to
+	// out and subject to the other output options.
+	ReduceStages []Reducer
+	// FeederWorkers, if set, is the number of goroutines sending the emitted
+	// values to the reducers. By default a goroutine is started per value so a
+	// reducer slow to consume its values never blocks the others. Once all the
+	// workers are blocked on slow reducers, the mappers block on Emit, so a
+	// reducer must not wait on another reducer's progress before consuming its
+	// values. It is ignored with OrderedValues, which uses one goroutine per
+	// reduce key.
+	FeederWorkers int
+	// Combiner, if set, merges the values emitted by each mapper call per
+	// reduce key. The values are held until Map returns. The combined values
+	// are what is cached.
+	Combiner Combiner
+	// DedupeEmits drops the values a mapper call emits more than once for the
+	// same reduce key, so each unique (reduce key, value) pair is sent to the
+	// reducer and cached once per map key. Values are compared by their type
+	// and gob encoding; a value that fails to encode is never deduplicated.
+	// With Combiner, the duplicates are dropped before being combined.
+	DedupeEmits bool
+	// RequireEmission reports a MapError for each map key whose Map call
+	// returned nil without emitting any value, for pipelines where an empty
+	// output is a bug. Values dropped afterward, e.g. by ExpectValueType or
+	// DedupeEmits, still count as emitted. Like any MapError, the map key is
+	// not cached. Cache hits are not checked.
+	RequireEmission bool
+	// IntermediateOut, if set, receives a copy of each KeyValue emitted by the
+	// mappers or replayed from the cache, as it is sent to the reduce phase.
+	// It is meant for debugging mappers. Sends never block the run: a KeyValue
+	// is dropped when IntermediateOut is full, so use a buffered channel large
+	// enough to hold all the values. It is not closed.
+	IntermediateOut chan<- KeyValue
+	// RateLimiter, if set, is waited on before each mapper call, e.g. to not
+	// hammer a remote server. Cache hits are not limited. The wait happens
+	// once the mapper started so it counts against MaxMappers. Cancellation
+	// interrupts the wait.
+	RateLimiter Limiter
+	// MapOnly skips the reduce phase: the values emitted by the mappers are
+	// sent as-is to out and the reducer is not used. It is faster than
+	// ReducePassThrough since the values are not grouped. MaxOutput,
+	// DetectDuplicateOutput and OutputLog still apply.
+	MapOnly bool
+	// ContiguousOutput holds the outputs of each reducer until its Reduce
+	// returns, then sends them to out in Output() call order without
+	// interleaving with the outputs of other reducers. The consumer of out
+	// then receives the outputs of each reducer as one contiguous run.
+	ContiguousOutput bool
+	// AccumulatorBuffer is the buffer size of the channel carrying the emitted
+	// values from the mappers to the reduce phase. By default it is unbuffered
+	// so Emit returns only once the value was picked up. A larger buffer lets
+	// mappers run ahead of a bursty reduce phase at the cost of holding up to
+	// that many values in memory, in addition to MaxBufferedValues.
+	AccumulatorBuffer int
+	// Deterministic runs the mappers one at a time in generator order,
+	// ignoring the key priorities, then the reducers like SerialReduce. The
+	// values are received by each reducer in emission order. It gives up all
+	// parallelism in exchange of reproducible runs, e.g. in unit tests. It
+	// produces the same results as a concurrent run.
+	Deterministic bool
+	// CacheKeyFunc, if set, computes the key under which the values emitted
+	// for a map key are stored in and looked up from the cache, e.g. a
+	// canonicalized URL or a hash. MapIO.MapKey() still returns the map key
+	// sent by the generator. The generator must not send two map keys with the
+	// same cache key in a single run, since both would be stored in the same
+	// entry.
+	CacheKeyFunc func(mapKey string) string
+	// CachePredicate, if set, returns whether the values of a map key are
+	// cached. For the map keys where it returns false, e.g. a live endpoint,
+	// the cache is neither read nor written so their mapper always runs, and
+	// they count as neither a cache hit nor a cache miss in PerfStats.
+	CachePredicate func(mapKey string) bool
+	// ExpectValueType, if set, is a value of the only type the mapper may
+	// emit. Values of another type, including nil, are dropped and an error is
+	// sent to errChan, so the reducer can safely assert the type. It applies
+	// with or without a MappingCache.
+	ExpectValueType interface{}
+	// OutputLog, if set, records each final key sent to out. The final keys
+	// already recorded when it was opened, e.g. by an interrupted run, are not
+	// output again; a final key output multiple times in the same run is
+	// output every time. Since the reducers still run, it is meant to save the
+	// work of the consumer of out.
+	OutputLog *OutputLog
+	// ReduceCache, if set, caches the outputs of each reducer, keyed by the
+	// reduce key. The entry also holds a hash of the values, as a first
+	// KeyValue with a nil value. A reducer whose values didn't change since a
+	// previous run is skipped and its outputs are replayed; otherwise its
+	// entry is replaced. The types of the outputs must be registered in
+	// ReduceCache.
+	//
+	// All the values are grouped before starting the reducers, like with
+	// PhasedExecution. The hash doesn't depend on the order of the values.
+	// Values whose gob encoding isn't deterministic, e.g. maps, are always a
+	// miss. MappingCache.Compact with the reduce keys drops the entries of
+	// the reduce keys no longer produced.
+	ReduceCache *MappingCache
+	// OutputCache, if set, also stores each KeyValue sent to out as a cache
+	// entry keyed by its final key. The first output of a final key replaces
+	// the entry left by a previous run and the following ones in the same run
+	// append to it. A following MapReduce using it as its cache, with
+	// the final keys as map keys, then gets each of them as a cache hit that
+	// emits the outputs with the final key as reduce key.
+	OutputCache *MappingCache
+	// Clock, if set, is used for all the time measurements instead of the
+	// system clock, e.g. to make tests deterministic.
+	Clock Clock
+	// Progress, if set, receives an event each time a map key is done. Sends
+	// are blocking so the caller must drain it concurrently, like out; use a
+	// buffered channel to absorb a slow reader. It is not closed.
+	Progress chan<- ProgressEvent
+	// OnReduceDone, if set, is called each time a reducer is done with the
+	// number of outputs it produced and the time from its start until it
+	// returned and its outputs were sent. It is called concurrently from the
+	// reducer goroutines. It is not called for the reduce keys whose outputs
+	// are replayed from ReduceCache.
+	OnReduceDone func(reduceKey string, outputs int, d time.Duration)
+	// MapperTimeout, if set, bounds the duration of each Map call. Once
+	// expired, the context returned by MapIO.Context is done and the map key
+	// is reported as a MapError without waiting for Map to return. The values
+	// emitted afterward by the abandoned call are dropped and the map key is
+	// not cached. Map should return once its context is done so the goroutine
+	// is not leaked. 0 means no timeout.
+	MapperTimeout time.Duration
+	// GroupedOut, if set, receives the outputs grouped by final key instead of
+	// out, once all the reducers are done. The groups are sent in the order
+	// their final key was first output and the values in the order they were
+	// output. It is closed once all the groups were sent, before out is
+	// closed; out receives nothing. All the outputs are held in memory in the
+	// meantime. OutputLog, OutputCache and MaxOutput record a group when it is
+	// sent, so a group that was never received is output again by a resumed
+	// run. The other output options apply to each output as usual.
+	GroupedOut chan<- FinalGroup
+	// MergeOutput, if set, combines the values output for the same final key
+	// into a single one so out receives one KeyValue per final key. a is the
+	// value merged so far and b the next value output, in output order. Like
+	// GroupedOut, the KeyValues are sent once all the reducers are done, in
+	// the order their final key was first output, and all the outputs are held
+	// in memory in the meantime. It is ignored with GroupedOut. Like with
+	// GroupedOut, OutputLog, OutputCache and MaxOutput record the merged
+	// KeyValue when it is sent. The other output options apply to each output
+	// before it is merged, e.g. b is a SourcedValue with AnnotateSource.
+	MergeOutput func(key string, a, b interface{}) interface{}
+	// Warnings, if set, receives the warnings reported with MapIO.Warn instead
+	// of errChan. Like errChan, sends are blocking so it must be drained
+	// concurrently. It is not closed.
+	Warnings chan<- error
+}
+
+// ProgressEvent is sent to Options.Progress each time a map key is done.
+type ProgressEvent struct {
+	MapKey    string
+	FromCache bool  // True if the mapper was skipped because of a cache hit.
+	Err       error // The error returned by the mapper, if any.
+}
+
 // MapReduce runs a complete map reduce and returns when done.
 //
 // It exhausts generator and closes out once done. Any error is sent to
-// errChan. The optional cache is used to skip mapping steps. Perf stats are
-// updated live to perf.
+// errChan; errChan may be nil, in which case errors are discarded unless
+// Options.PanicOnError is set. The optional cache is used to skip mapping
+// steps. Perf stats are updated live to perf.
+//
+// The errors are sent as they occur in the concurrent mappers and reducers, so
+// their order is not deterministic, even across runs on the same keys. Use
+// SortErrors to order the collected errors by key.
 func MapReduce(generator <-chan string, out chan<- KeyValue, errChan chan<- error, cache *MappingCache, perf *PerfStats, mapper Mapper, reducer Reducer) {
+	MapReduceWithOptions(generator, out, errChan, cache, perf, mapper, reducer, nil)
+}
+
+// MapReduceWithOptions is MapReduce with tunable behavior. opts may be nil.
+//
+// When the run is stopped early, generator is not exhausted.
+func MapReduceWithOptions(generator <-chan string, out chan<- KeyValue, errChan chan<- error, cache *MappingCache, perf *PerfStats, mapper Mapper, reducer Reducer, opts *Options) {
+	_ = MapReduceContext(context.Background(), generator, out, errChan, cache, perf, mapper, reducer, opts)
+}
+
+// MapReduceContext is MapReduceWithOptions that stops early once ctx is
+// cancelled.
+//
+// It is MapReducePrioritized where all the keys have the same priority.
+//
+// Once ctx is cancelled, pending sends to out and errChan are abandoned so the
+// function returns even if the consumer stopped reading. Mappers and reducers
+// already running are waited for. It returns ctx.Err() if the run was cut
+// short by ctx, the error that stopped the run with Options.FailFast or
+// Options.IsFatal, nil otherwise.
+func MapReduceContext(ctx context.Context, generator <-chan string, out chan<- KeyValue, errChan chan<- error, cache *MappingCache, perf *PerfStats, mapper Mapper, reducer Reducer, opts *Options) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	keys := make(chan PrioritizedKey)
+	go func() {
+		defer close(keys)
+		for {
+			select {
+			case k, ok := <-generator:
+				if !ok {
+					return
+				}
+				select {
+				case keys <- PrioritizedKey{Key: k}:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return MapReducePrioritized(ctx, keys, out, errChan, cache, perf, mapper, reducer, opts)
+}
+
+// MapReducePrioritized is MapReduceContext where each key carries a
+// scheduling priority.
+//
+// When Options.MaxMappers limits the number of concurrent mappers, the pending
+// key with the highest priority is started first whenever a mapper slot frees
+// up. Keys with the same priority are started in generator order. This is
+// best effort since only the keys already read from generator are considered;
+// to bound memory use, up to 16 keys per mapper slot are read ahead.
+func MapReducePrioritized(ctx context.Context, generator <-chan PrioritizedKey, out chan<- KeyValue, errChan chan<- error, cache *MappingCache, perf *PerfStats, mapper Mapper, reducer Reducer, opts *Options) error {
 	var wg sync.WaitGroup
 
-	if cache != nil && cache.Data == nil {
-		cache.Data = make(map[string]*cacheValues)
+	j := &job{errChan: errChan, cache: cache, perf: perf, mapper: mapper, reducer: reducer}
+	if opts != nil {
+		j.opts = *opts
+	}
+	j.clock = j.opts.Clock
+	if j.clock == nil {
+		j.clock = systemClock{}
+	}
+	j.valueType = reflect.TypeOf(j.opts.ExpectValueType)
+	if j.opts.MaxBufferedValues > 0 && j.opts.MaxReducers == 0 {
+		j.buffered = make(chan struct{}, j.opts.MaxBufferedValues)
 	}
+	if j.opts.MaxReducers > 0 {
+		j.reducers = make(chan struct{}, j.opts.MaxReducers)
+	}
+	j.ctx, j.cancel = context.WithCancel(ctx)
+	defer j.cancel()
 
-	accumulator := make(chan KeyValue)
+	accumulator := make(chan KeyValue, j.opts.AccumulatorBuffer)
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		runMap(generator, accumulator, errChan, cache, perf, mapper)
+		j.runMap(generator, accumulator)
 		close(accumulator)
 	}()
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		runReduce(accumulator, out, errChan, perf, reducer)
+		if j.opts.GroupedOut != nil {
+			j.runReduceGrouped(ctx, accumulator)
+		} else if j.opts.MergeOutput != nil {
+			j.runReduceMerged(ctx, accumulator, out)
+		} else {
+			j.runReducePipeline(accumulator, out)
+		}
 		close(out)
 	}()
 
 	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return j.abortErr()
 }
 
-// ReducePassThrough passes the values mapped directly as-is.
-type ReducePassThrough struct {
+// Private bits.
+
+// job is the state of a single MapReduce run.
+type job struct {
+	ctx     context.Context // Cancelled when the run must stop early.
+	cancel  func()
+	opts    Options
+	errChan chan<- error
+	cache   *MappingCache
+	perf    *PerfStats
+	mapper  Mapper
+	reducer Reducer
+
+	outputReserved int64 // Number of Output() calls allowed to send to out.
+	outputSent     int64 // Number of KeyValue sent to out.
+	errors         int64 // Number of errors reported, for Options.MaxErrors.
+
+	freshLock sync.Mutex
+	fresh     map[string]bool // Group keys with values emitted by a mapper, for Options.AnnotateSource.
+
+	outputKeysLock sync.Mutex
+	outputKeys     map[string]struct{} // Only used with Options.DetectDuplicateOutput.
+
+	outputCachedLock sync.Mutex
+	outputCached     map[string]struct{} // Final keys stored in Options.OutputCache by this run.
+
+	abortLock sync.Mutex
+	aborted   error // Set by abort().
+
+	buffered  chan struct{} // Semaphore for Options.MaxBufferedValues.
+	reducers  chan struct{} // Semaphore for Options.MaxReducers.
+	clock     Clock         // Options.Clock or systemClock.
+	valueType reflect.Type  // Type of Options.ExpectValueType.
+
+	outputLock sync.Mutex // Serializes the flushes of Options.ContiguousOutput.
 }
 
-// Reduce implements Reducer.
-func (r *ReducePassThrough) Reduce(io ReduceIO) error {
-	key := io.ReduceKey()
-	for i := range io.ReduceValues() {
-		io.Output(key, i)
+// reportError sends err to errChan, unless the run is cancelled.
+func (j *job) reportError(err error) {
+	if j.errChan == nil {
+		if j.opts.PanicOnError {
+			panic(err)
+		}
+	} else {
+		select {
+		case j.errChan <- err:
+		case <-j.ctx.Done():
+		}
+	}
+	if j.opts.FailFast || (j.opts.IsFatal != nil && j.opts.IsFatal(err)) {
+		j.abort(err)
+	}
+	if max := int64(j.opts.MaxErrors); max > 0 {
+		if n := atomic.AddInt64(&j.errors, 1); n > max {
+			j.abort(fmt.Errorf("stopped after %d errors: %w", n, err))
+		}
 	}
-	return nil
 }
 
-// Private bits.
+// markFresh records that a mapper emitted kvs, for Options.AnnotateSource.
+func (j *job) markFresh(kvs []KeyValue) {
+	j.freshLock.Lock()
+	defer j.freshLock.Unlock()
+	if j.fresh == nil {
+		j.fresh = map[string]bool{}
+	}
+	for _, kv := range kvs {
+		j.fresh[j.groupKey(kv.Key)] = true
+	}
+}
 
-type cacheValues struct {
-	dirty bool
-	Items []serializedKeyValue
+// fromCache returns true if no value emitted for groupKey was computed by a
+// mapper.
+func (j *job) fromCache(groupKey string) bool {
+	j.freshLock.Lock()
+	defer j.freshLock.Unlock()
+	return !j.fresh[groupKey]
 }
 
-type serializedKeyValue struct {
-	Key   string
-	Value []byte // GobEncoded object.
+// allFromCache returns true if no value was computed by a mapper.
+func (j *job) allFromCache() bool {
+	j.freshLock.Lock()
+	defer j.freshLock.Unlock()
+	return len(j.fresh) == 0
+}
+
+// warn sends w to Options.Warnings, or to errChan. Warnings never stop the
+// run.
+func (j *job) warn(w *Warning) {
+	c := j.opts.Warnings
+	if c == nil {
+		c = j.errChan
+	}
+	if c == nil {
+		return
+	}
+	select {
+	case c <- w:
+	case <-j.ctx.Done():
+	}
+}
+
+// abort cancels the run because of err. Only the first error is kept.
+func (j *job) abort(err error) {
+	j.abortLock.Lock()
+	if j.aborted == nil {
+		j.aborted = err
+	}
+	j.abortLock.Unlock()
+	j.cancel()
+}
+
+// abortErr returns the error passed to abort(), if any.
+func (j *job) abortErr() error {
+	j.abortLock.Lock()
+	defer j.abortLock.Unlock()
+	return j.aborted
+}
+
+// acquireValue blocks until one more value can be in flight to the reducers,
+// as limited by Options.MaxBufferedValues. It returns false if the run is
+// cancelled.
+func (j *job) acquireValue() bool {
+	if j.buffered == nil {
+		return true
+	}
+	select {
+	case j.buffered <- struct{}{}:
+		return true
+	case <-j.ctx.Done():
+		return false
+	}
+}
+
+// acquireReducer blocks until a reducer can start, as bounded by
+// Options.MaxReducers. It returns false if the run was cancelled in the
+// meantime.
+func (j *job) acquireReducer() bool {
+	if j.reducers == nil {
+		return true
+	}
+	select {
+	case j.reducers <- struct{}{}:
+		return true
+	case <-j.ctx.Done():
+		return false
+	}
+}
+
+// releaseReducer is called once a reducer started with acquireReducer
+// returned.
+func (j *job) releaseReducer() {
+	if j.reducers != nil {
+		<-j.reducers
+	}
+}
+
+// releaseValue is called once a value acquired with acquireValue was received
+// by its reducer.
+func (j *job) releaseValue() {
+	if j.buffered != nil {
+		<-j.buffered
+	}
+}
+
+// markOutputKey records finalKey as output and returns true if it already
+// was.
+func (j *job) markOutputKey(finalKey string) bool {
+	j.outputKeysLock.Lock()
+	defer j.outputKeysLock.Unlock()
+	if _, ok := j.outputKeys[finalKey]; ok {
+		return true
+	}
+	if j.outputKeys == nil {
+		j.outputKeys = map[string]struct{}{}
+	}
+	j.outputKeys[finalKey] = struct{}{}
+	return false
 }
 
 type mapIO struct {
+	j            *job
 	mapKey       string
+	cache        *MappingCache // nil if the values of mapKey are not cached.
+	cacheKey     string        // Options.CacheKeyFunc(mapKey).
 	mapperOutput chan<- KeyValue
-	cache        *MappingCache
-	errChan      chan<- error
+	ctx          context.Context // Context of the Map call, see Options.MapperTimeout.
+	emits        int64           // Number of values passed to EmitBatch, for Options.RequireEmission.
+
+	// Set once the Map call timed out, so the values it still emits are
+	// dropped.
+	emitLock    sync.Mutex
+	abandoned   bool
+	cacheFailed bool // Set once a value failed to be cached, so the map key is not cached.
+
+	// Hashes of the values already emitted, for Options.DedupeEmits.
+	dedupeLock sync.Mutex
+	emitted    map[string]struct{}
+
+	// Values held for Options.Combiner, by reduce key in first Emit() order.
+	combineLock sync.Mutex
+	combineKeys []string
+	combined    map[string][]interface{}
 }
 
 func (m *mapIO) MapKey() string {
 	return m.mapKey
 }
 
+func (m *mapIO) MapKeyBytes() []byte {
+	return []byte(m.mapKey)
+}
+
 func (m *mapIO) Emit(reduceKey string, reduceValue interface{}) {
-	if m.cache != nil {
-		t := reflect.TypeOf(reduceValue)
-		if m.cache.valueType != t {
-			m.errChan <- fmt.Errorf("expected type %v, got %v", m.cache.valueType, t)
+	m.EmitBatch([]KeyValue{{reduceKey, reduceValue}})
+}
+
+func (m *mapIO) EmitBatch(kvs []KeyValue) {
+	atomic.AddInt64(&m.emits, int64(len(kvs)))
+	if t := m.j.valueType; t != nil {
+		valid := kvs[:0:0]
+		for _, kv := range kvs {
+			if vt := reflect.TypeOf(kv.Value); vt != t {
+				m.j.reportError(&MapError{m.mapKey, &TypeMismatchError{t, vt}})
+				continue
+			}
+			valid = append(valid, kv)
+		}
+		kvs = valid
+	}
+	if m.j.opts.DedupeEmits {
+		kvs = m.dedupe(kvs)
+	}
+	if m.j.opts.Combiner != nil {
+		m.combineLock.Lock()
+		defer m.combineLock.Unlock()
+		if m.combined == nil {
+			m.combined = map[string][]interface{}{}
+		}
+		for _, kv := range kvs {
+			if _, ok := m.combined[kv.Key]; !ok {
+				m.combineKeys = append(m.combineKeys, kv.Key)
+			}
+			m.combined[kv.Key] = append(m.combined[kv.Key], kv.Value)
+		}
+		return
+	}
+	m.emit(kvs)
+}
+
+func (m *mapIO) Context() context.Context {
+	return m.ctx
+}
+
+// abandon drops the values emitted from now on, once the Map call timed out.
+func (m *mapIO) abandon() {
+	m.emitLock.Lock()
+	defer m.emitLock.Unlock()
+	m.abandoned = true
+}
+
+func (m *mapIO) Warn(format string, args ...interface{}) {
+	m.j.warn(&Warning{m.mapKey, fmt.Errorf(format, args...)})
+}
+
+// dedupe returns the items of kvs not already emitted, for
+// Options.DedupeEmits.
+func (m *mapIO) dedupe(kvs []KeyValue) []KeyValue {
+	m.dedupeLock.Lock()
+	defer m.dedupeLock.Unlock()
+	if m.emitted == nil {
+		m.emitted = map[string]struct{}{}
+	}
+	unique := kvs[:0:0]
+	for _, kv := range kvs {
+		h, err := hashValues([]interface{}{kv.Value})
+		if err == nil {
+			k := kv.Key + "\x00" + h
+			if _, ok := m.emitted[k]; ok {
+				continue
+			}
+			m.emitted[k] = struct{}{}
+		}
+		unique = append(unique, kv)
+	}
+	return unique
+}
+
+// combine runs Options.Combiner over the values held by EmitBatch and emits
+// the results.
+func (m *mapIO) combine() error {
+	m.combineLock.Lock()
+	defer m.combineLock.Unlock()
+	kvs := make([]KeyValue, 0, len(m.combineKeys))
+	var err error
+	for _, k := range m.combineKeys {
+		v, err2 := m.j.opts.Combiner.Combine(k, m.combined[k])
+		if err2 != nil {
+			if err == nil {
+				err = fmt.Errorf("failed to combine %s: %s", k, err2)
+			}
+			continue
+		}
+		kvs = append(kvs, KeyValue{k, v})
+	}
+	m.combineKeys = nil
+	m.combined = nil
+	m.emit(kvs)
+	return err
+}
+
+// emit caches kvs and sends them to the reducers.
+func (m *mapIO) emit(kvs []KeyValue) {
+	// Hold emitLock so no value is cached once the map key was dropped from
+	// the cache after a timeout, and no value is sent once the map phase may
+	// be done.
+	m.emitLock.Lock()
+	defer m.emitLock.Unlock()
+	if m.abandoned {
+		return
+	}
+	if m.j.opts.AnnotateSource {
+		m.j.markFresh(kvs)
+	}
+	if c := m.cache; c != nil {
+		items := make([]CacheItem, 0, len(kvs))
+		var errs []error
+		for _, kv := range kvs {
+			item, err := c.encode(m.mapKey, kv)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			items = append(items, item)
+		}
+		// Report the type errors first since they explain the encoding ones.
+		// Like with Options.ExpectValueType, they are attributed to the map key.
+		typeErrs, err := c.add(m.cacheKey, kvs, items)
+		for i := range typeErrs {
+			typeErrs[i] = &MapError{m.mapKey, typeErrs[i]}
+		}
+		for _, err := range append(typeErrs, errs...) {
+			m.j.reportError(err)
+			m.cacheFailed = true
+		}
+		if err != nil {
+			m.j.reportError(fmt.Errorf("failed to write to cache key %s: %s", m.mapKey, err))
+			m.cacheFailed = true
+		}
+	}
+	for _, kv := range kvs {
+		select {
+		case m.mapperOutput <- kv:
+			m.j.intermediate(kv)
+		case <-m.j.ctx.Done():
+			return
 		}
-		m.cache.add(m.mapKey, reduceKey, reduceValue, m.errChan)
 	}
-	m.mapperOutput <- KeyValue{reduceKey, reduceValue}
 }
 
 type reduceIO struct {
+	j             *job
 	reduceKey     string
 	reducerInput  chan interface{}
 	reducerOutput chan<- KeyValue
+	feeder        *orderedFeeder // Only set with Options.OrderedValues or Options.MaxReducers.
+	numValues     int64
+	outputs       int64 // Number of Output() calls, for Options.OnReduceDone.
+
+	pendingLock sync.Mutex
+	pending     []KeyValue // Outputs held until Reduce returns with Options.ContiguousOutput.
+	record      bool       // Set to record the outputs in recorded, for Options.ReduceCache.
+	partial     bool       // Set to only record the outputs, for Options.ReduceParallelismPerKey.
+	stage       int        // 0 for the reducer, i for Options.ReduceStages[i-1].
+	forward     bool       // Set with Options.MapOnly; the final keys are the reduce keys.
+	recorded    []KeyValue
 }
 
 func (r *reduceIO) ReduceKey() string {
@@ -186,149 +1025,821 @@ func (r *reduceIO) ReduceValues() <-chan interface{} {
 	return r.reducerInput
 }
 
+func (r *reduceIO) NumValues() int {
+	return int(atomic.LoadInt64(&r.numValues))
+}
+
+func (r *reduceIO) Cancelled() bool {
+	return r.j.ctx.Err() != nil
+}
+
 func (r *reduceIO) Output(finalKey string, finalValue interface{}) {
-	r.reducerOutput <- KeyValue{finalKey, finalValue}
+	atomic.AddInt64(&r.outputs, 1)
+	if r.record {
+		r.pendingLock.Lock()
+		r.recorded = append(r.recorded, KeyValue{finalKey, finalValue})
+		r.pendingLock.Unlock()
+	}
+	if r.partial {
+		return
+	}
+	if r.stage < len(r.j.opts.ReduceStages) {
+		// Intermediate stage: the outputs are the values of the next stage.
+		select {
+		case r.reducerOutput <- KeyValue{finalKey, finalValue}:
+		case <-r.j.ctx.Done():
+		}
+		return
+	}
+	if r.j.opts.ContiguousOutput {
+		r.pendingLock.Lock()
+		r.pending = append(r.pending, KeyValue{finalKey, finalValue})
+		r.pendingLock.Unlock()
+		return
+	}
+	r.send(finalKey, finalValue)
+}
+
+// fromCache returns the SourcedValue.FromCache of the output finalKey.
+func (r *reduceIO) fromCache(finalKey string) bool {
+	switch {
+	case r.stage > 0:
+		return r.j.allFromCache()
+	case r.forward:
+		return r.j.fromCache(r.j.groupKey(finalKey))
+	default:
+		return r.j.fromCache(r.reduceKey)
+	}
+}
+
+// flush sends the outputs held with Options.ContiguousOutput, without
+// interleaving with the outputs of other reducers.
+func (r *reduceIO) flush() {
+	r.pendingLock.Lock()
+	pending := r.pending
+	r.pending = nil
+	r.pendingLock.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	r.j.outputLock.Lock()
+	defer r.j.outputLock.Unlock()
+	for _, kv := range pending {
+		r.send(kv.Key, kv.Value)
+	}
+}
+
+// send sends a final KeyValue to out.
+func (r *reduceIO) send(finalKey string, finalValue interface{}) {
+	j := r.j
+	if l := j.opts.OutputLog; l != nil && l.has(finalKey) {
+		return
+	}
+	// With GroupedOut or MergeOutput, the outputs are recorded once they are
+	// delivered as part of a group; see runReduceGrouped.
+	grouped := j.opts.GroupedOut != nil || j.opts.MergeOutput != nil
+	if !grouped && !j.reserveOutput() {
+		return
+	}
+	if j.opts.DetectDuplicateOutput && j.markOutputKey(finalKey) {
+		j.reportError(fmt.Errorf("final key %s was output more than once", finalKey))
+	}
+	v := finalValue
+	if j.opts.AnnotateSource {
+		v = SourcedValue{finalValue, r.fromCache(finalKey)}
+	}
+	var start time.Time
+	if j.perf != nil {
+		start = j.clock.Now()
+	}
+	select {
+	case r.reducerOutput <- KeyValue{finalKey, v}:
+		j.outputBlocked(start)
+		if !grouped {
+			j.delivered(finalKey, finalValue)
+		}
+	case <-j.ctx.Done():
+		j.outputBlocked(start)
+	}
 }
 
-func runMap(generator <-chan string, accumulator chan<- KeyValue, errChan chan<- error, c *MappingCache, p *PerfStats, mapper Mapper) {
+// reserveOutput returns false once Options.MaxOutput outputs were reserved.
+func (j *job) reserveOutput() bool {
+	max := int64(j.opts.MaxOutput)
+	return max <= 0 || atomic.AddInt64(&j.outputReserved, 1) <= max
+}
+
+// delivered records that the values of finalKey were received from out or
+// Options.GroupedOut, for Options.OutputLog, Options.OutputCache and
+// Options.MaxOutput.
+func (j *job) delivered(finalKey string, values ...interface{}) {
+	if l := j.opts.OutputLog; l != nil {
+		if err := l.add(finalKey); err != nil {
+			j.reportError(err)
+		}
+	}
+	if j.opts.OutputCache != nil {
+		for _, v := range values {
+			if s, ok := v.(SourcedValue); ok && j.opts.AnnotateSource {
+				v = s.Value
+			}
+			j.cacheOutput(KeyValue{finalKey, v})
+		}
+	}
+	if max := int64(j.opts.MaxOutput); max > 0 && atomic.AddInt64(&j.outputSent, 1) == max {
+		j.cancel()
+	}
+}
+
+// cacheOutput stores kv in Options.OutputCache. The first output of a final key
+// in this run replaces the entry left by a previous run; the following ones
+// append to it.
+func (j *job) cacheOutput(kv KeyValue) {
+	j.outputCachedLock.Lock()
+	defer j.outputCachedLock.Unlock()
+	_, seen := j.outputCached[kv.Key]
+	if j.outputCached == nil {
+		j.outputCached = map[string]struct{}{}
+	}
+	j.outputCached[kv.Key] = struct{}{}
+	if err := j.opts.OutputCache.appendOutput(kv, !seen); err != nil {
+		j.reportError(err)
+	}
+}
+
+// outputBlocked accounts the time blocked on out since start, for
+// PerfStats.OutputBlockedDuration.
+func (j *job) outputBlocked(start time.Time) {
+	if p := j.perf; p != nil {
+		atomic.AddInt64(&p.outputBlocked, int64(j.clock.Now().Sub(start)))
+	}
+}
+
+// orderedFeeder forwards values to a reducer in the order they were pushed,
+// without ever blocking the caller of push().
+type orderedFeeder struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	values []interface{}
+	closed bool
+}
+
+func newOrderedFeeder() *orderedFeeder {
+	f := &orderedFeeder{}
+	f.cond = sync.NewCond(&f.lock)
+	return f
+}
+
+func (f *orderedFeeder) push(v interface{}) {
+	f.lock.Lock()
+	f.values = append(f.values, v)
+	f.lock.Unlock()
+	f.cond.Signal()
+}
+
+// close signals that no more values will be pushed. dst is closed once the
+// pending values are sent.
+func (f *orderedFeeder) close() {
+	f.lock.Lock()
+	f.closed = true
+	f.lock.Unlock()
+	f.cond.Signal()
+}
+
+// run sends the values to dst and calls sent() after each of them.
+func (f *orderedFeeder) run(dst chan<- interface{}, done <-chan struct{}, sent func()) {
+	for {
+		f.lock.Lock()
+		for len(f.values) == 0 && !f.closed {
+			f.cond.Wait()
+		}
+		if len(f.values) == 0 {
+			f.lock.Unlock()
+			close(dst)
+			return
+		}
+		v := f.values[0]
+		f.values[0] = nil
+		f.values = f.values[1:]
+		f.lock.Unlock()
+		select {
+		case dst <- v:
+		case <-done:
+		}
+		sent()
+	}
+}
+
+func (j *job) runMap(generator <-chan PrioritizedKey, accumulator chan<- KeyValue) {
+	if j.opts.Deterministic {
+		j.runMapSerial(generator, accumulator)
+		return
+	}
 	var wg sync.WaitGroup
-	for mapKey := range generator {
+	var slots chan struct{}
+	if j.opts.MaxMappers > 0 {
+		slots = make(chan struct{}, j.opts.MaxMappers)
+	}
+	j.schedule(generator, slots, func(key string) {
 		wg.Add(1)
-		if p != nil {
+		if p := j.perf; p != nil {
 			atomic.AddInt64(&p.mappersRunning, 1)
 		}
-		go func(key string) {
+		go func() {
 			defer wg.Done()
 			defer func() {
-				if p != nil {
+				if p := j.perf; p != nil {
 					atomic.AddInt64(&p.mappersRunning, -1)
 				}
+				if slots != nil {
+					<-slots
+				}
 			}()
-			if c != nil {
-				if v := c.get(key, errChan); v != nil {
-					// Cache hit.
-					if p != nil {
-						atomic.AddInt64(&p.cacheHits, 1)
-					}
-					for i := range v {
-						accumulator <- i
-					}
-					return
+			j.mapKey(key, accumulator)
+		}()
+	})
+	wg.Wait()
+
+	if c := j.cache; c != nil {
+		if err := c.ClearDirty(); err != nil {
+			j.reportError(err)
+		}
+	}
+}
+
+// runMapSerial is runMap with Options.Deterministic. It maps the keys one at a
+// time in generator order, ignoring their priority.
+func (j *job) runMapSerial(generator <-chan PrioritizedKey, accumulator chan<- KeyValue) {
+	for {
+		var pk PrioritizedKey
+		ok := false
+		select {
+		case pk, ok = <-generator:
+		case <-j.ctx.Done():
+		}
+		if !ok {
+			break
+		}
+		if p := j.perf; p != nil {
+			atomic.AddInt64(&p.mappersRunning, 1)
+		}
+		j.mapKey(pk.Key, accumulator)
+		if p := j.perf; p != nil {
+			atomic.AddInt64(&p.mappersRunning, -1)
+		}
+	}
+
+	if c := j.cache; c != nil {
+		if err := c.ClearDirty(); err != nil {
+			j.reportError(err)
+		}
+	}
+}
+
+// mapKey runs the mapper for a single key, or replays its values from the
+// cache.
+func (j *job) mapKey(key string, accumulator chan<- KeyValue) {
+	c := j.cache
+	uncached := c != nil && j.opts.CachePredicate != nil && !j.opts.CachePredicate(key)
+	if uncached {
+		c = nil
+	}
+	p := j.perf
+	cacheKey := j.cacheKey(key)
+	if c != nil {
+		if v := c.get(cacheKey, j.clock, j.reportError); v != nil {
+			// Cache hit.
+			if p != nil {
+				atomic.AddInt64(&p.cacheHits, 1)
+			}
+			for _, i := range v {
+				select {
+				case accumulator <- i:
+					j.intermediate(i)
+				case <-j.ctx.Done():
 				}
 			}
-			if p != nil {
-				atomic.AddInt64(&p.cacheMisses, 1)
+			j.progress(ProgressEvent{MapKey: key, FromCache: true})
+			return
+		}
+	}
+	if p != nil && !uncached {
+		atomic.AddInt64(&p.cacheMisses, 1)
+	}
+	if l := j.opts.RateLimiter; l != nil {
+		wait := l.Wait
+		if s, ok := l.(*spacer); ok {
+			// Read the time from Options.Clock.
+			wait = func(ctx context.Context) error { return s.wait(ctx, j.clock) }
+		}
+		if wait(j.ctx) != nil {
+			// Cancelled.
+			return
+		}
+	}
+	io := &mapIO{j: j, mapKey: key, cache: c, cacheKey: cacheKey, mapperOutput: accumulator, ctx: j.ctx}
+	var err error
+	if j.opts.MapperTimeout > 0 {
+		err = j.mapWithTimeout(io)
+	} else {
+		err = j.callMap(io)
+	}
+	if err == nil && j.opts.RequireEmission && atomic.LoadInt64(&io.emits) == 0 {
+		err = errors.New("no value emitted")
+	}
+	if j.opts.Combiner != nil {
+		if err2 := io.combine(); err == nil {
+			err = err2
+		}
+	}
+	io.emitLock.Lock()
+	cacheFailed := io.cacheFailed
+	io.emitLock.Unlock()
+	if err != nil {
+		err = &MapError{key, err}
+		j.reportError(err)
+		if c != nil {
+			if err2 := c.drop(cacheKey); err2 != nil {
+				j.reportError(err2)
 			}
-			if err := mapper.Map(&mapIO{key, accumulator, c, errChan}); err != nil {
-				errChan <- fmt.Errorf("failed to map %s: %s", key, err)
+		}
+	} else if c != nil && cacheFailed {
+		// Don't cache a partial result; the map key is mapped again next time.
+		if err2 := c.drop(cacheKey); err2 != nil {
+			j.reportError(err2)
+		}
+	} else if c != nil {
+		if err2 := c.complete(cacheKey); err2 != nil {
+			j.reportError(err2)
+		} else if err2 := c.appendLog(cacheKey); err2 != nil {
+			j.reportError(err2)
+		}
+	}
+	j.progress(ProgressEvent{MapKey: key, Err: err})
+}
+
+// callMap calls the mapper for io, recovering a panic with
+// Options.RecoverPanics.
+func (j *job) callMap(io *mapIO) (err error) {
+	if j.opts.RecoverPanics {
+		defer func() {
+			if r := recover(); r != nil {
+				err = j.panicError(r)
 			}
-		}(mapKey)
+		}()
 	}
-	wg.Wait()
+	return j.mapper.Map(io)
+}
 
-	if c != nil {
-		for _, v := range c.Data {
-			v.dirty = false
-		}
+// callReduce calls the reducer for io, recovering a panic with
+// Options.RecoverPanics.
+func (j *job) callReduce(io *reduceIO) (err error) {
+	if j.opts.RecoverPanics {
+		defer func() {
+			if r := recover(); r != nil {
+				err = j.panicError(r)
+			}
+		}()
+	}
+	if io.stage > 0 {
+		return j.opts.ReduceStages[io.stage-1].Reduce(io)
+	}
+	return j.reducer.Reduce(io)
+}
+
+// panicError returns the error for the recovered value r, as built by
+// Options.PanicFormatter. It must be called from the deferred function.
+func (j *job) panicError(r interface{}) error {
+	stack := debug.Stack()
+	if f := j.opts.PanicFormatter; f != nil {
+		return f(r, stack)
 	}
+	return fmt.Errorf("panic: %v\n%s", r, stack)
 }
 
-func runReduce(accumulator <-chan KeyValue, out chan<- KeyValue, errChan chan<- error, p *PerfStats, reducer Reducer) {
+// mapWithTimeout runs the mapper for io, abandoning it once
+// Options.MapperTimeout expired.
+func (j *job) mapWithTimeout(io *mapIO) error {
+	ctx, cancel := context.WithTimeout(j.ctx, j.opts.MapperTimeout)
+	defer cancel()
+	io.ctx = ctx
+	done := make(chan error, 1)
+	go func() {
+		done <- j.callMap(io)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+	select {
+	case err := <-done:
+		// Returned concurrently with the expiry.
+		return err
+	default:
+	}
+	if j.ctx.Err() != nil {
+		// The run was stopped; wait for the mapper like without a timeout.
+		return <-done
+	}
+	io.abandon()
+	return fmt.Errorf("timed out after %s", j.opts.MapperTimeout)
+}
+
+// intermediate sends kv to Options.IntermediateOut, if set, without blocking.
+func (j *job) intermediate(kv KeyValue) {
+	if j.opts.IntermediateOut == nil {
+		return
+	}
+	select {
+	case j.opts.IntermediateOut <- kv:
+	default:
+	}
+}
+
+// progress sends e to Options.Progress, if set.
+func (j *job) progress(e ProgressEvent) {
+	if j.opts.Progress == nil {
+		return
+	}
+	select {
+	case j.opts.Progress <- e:
+	case <-j.ctx.Done():
+	}
+}
+
+func (j *job) runReduce(accumulator <-chan KeyValue, out chan<- KeyValue) {
+	if j.opts.MapOnly {
+		j.forward(accumulator, out)
+		return
+	}
+	if j.opts.SerialReduce || j.opts.Deterministic {
+		j.runReduceSerial(accumulator, out)
+		return
+	}
+	if j.opts.ReduceCache != nil {
+		j.runReduceCached(accumulator, out)
+		return
+	}
+	if j.opts.PhasedExecution {
+		accumulator = j.drain(accumulator)
+	}
 	var lock sync.Mutex
 	buffer := make(map[string]*reduceIO)
 	var wgReducers sync.WaitGroup
 	var wgSeeds sync.WaitGroup
+	var seeds chan seedValue
+	// With MaxReducers, the values are queued by a feeder so the values of a
+	// reduce key waiting for a reducer never block the others.
+	queued := j.opts.OrderedValues || j.opts.MaxReducers > 0
+	if n := j.opts.FeederWorkers; n > 0 && !queued {
+		seeds = make(chan seedValue)
+		for i := 0; i < n; i++ {
+			wgSeeds.Add(1)
+			go func() {
+				defer wgSeeds.Done()
+				for s := range seeds {
+					j.seed(s.io, s.v)
+				}
+			}()
+		}
+	}
 
 	// For each emitted key pair.
-	for kp := range accumulator {
+	for {
+		var kp KeyValue
+		ok := false
+		select {
+		case kp, ok = <-accumulator:
+		case <-j.ctx.Done():
+		}
+		if !ok {
+			break
+		}
+		groupKey := j.groupKey(kp.Key)
 		lock.Lock()
-		r, ok := buffer[kp.Key]
+		r, ok := buffer[groupKey]
 		lock.Unlock()
 
 		if !ok {
-			r = &reduceIO{
-				reduceKey:     kp.Key,
-				reducerInput:  make(chan interface{}),
-				reducerOutput: out,
+			r = j.newReduceIO(groupKey, out)
+			if queued {
+				r.feeder = newOrderedFeeder()
+				go r.feeder.run(r.reducerInput, j.ctx.Done(), j.releaseValue)
 			}
 
 			lock.Lock()
-			buffer[kp.Key] = r
+			buffer[groupKey] = r
 			lock.Unlock()
 
 			// Start the reducer.
 			wgReducers.Add(1)
-			if p != nil {
-				atomic.AddInt64(&p.reducersRunning, 1)
-			}
 			go func(io *reduceIO) {
 				defer wgReducers.Done()
-				defer func() {
-					if p != nil {
-						atomic.AddInt64(&p.reducersRunning, -1)
-					}
-				}()
-				if err := reducer.Reduce(io); err != nil {
-					errChan <- fmt.Errorf("failed to reduce %s: %s", io.reduceKey, err)
+				if !j.acquireReducer() {
+					return
+				}
+				defer j.releaseReducer()
+				if j.opts.ReduceParallelismPerKey > 1 {
+					j.reduceParallel(io)
+				} else {
+					j.reduce(io)
 				}
 			}(r)
 		}
 
 		// Push the value.
+		if !j.acquireValue() {
+			break
+		}
+		n := atomic.AddInt64(&r.numValues, 1)
+		if p := j.perf; p != nil {
+			p.addReduceValue(n)
+		}
+		if r.feeder != nil {
+			r.feeder.push(kp.Value)
+			continue
+		}
+		if seeds != nil {
+			select {
+			case seeds <- seedValue{r, kp.Value}:
+			case <-j.ctx.Done():
+				j.releaseValue()
+			}
+			continue
+		}
 		wgSeeds.Add(1)
 		go func(io *reduceIO, v interface{}) {
 			defer wgSeeds.Done()
-			io.reducerInput <- v
+			j.seed(io, v)
 		}(r, kp.Value)
 	}
 
+	if seeds != nil {
+		close(seeds)
+	}
 	wgSeeds.Wait()
-	for _, r := range buffer {
-		close(r.reducerInput)
+	// Close the reducer inputs in reduce key order, not map order, so runs are
+	// reproducible as much as the scheduling permits.
+	keys := make([]string, 0, len(buffer))
+	for k := range buffer {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		r := buffer[k]
+		if r.feeder != nil {
+			r.feeder.close()
+		} else {
+			close(r.reducerInput)
+		}
 	}
 	wgReducers.Wait()
 }
 
-func (c *MappingCache) get(key string, errChan chan<- error) <-chan KeyValue {
-	c.lock.Lock()
-	v, ok := c.Data[key]
-	c.lock.Unlock()
+// runReduceGrouped is runReduce with Options.GroupedOut. The groups are sent
+// even if the run was stopped early, e.g. by FailFast, unless ctx is
+// cancelled. Each group is recorded once it is received.
+func (j *job) runReduceGrouped(ctx context.Context, accumulator <-chan KeyValue) {
+	defer close(j.opts.GroupedOut)
+	for _, g := range j.collectGroups(accumulator) {
+		if !j.reserveOutput() {
+			return
+		}
+		select {
+		case j.opts.GroupedOut <- g:
+			j.delivered(g.Key, g.Values...)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
 
-	if !ok || v.dirty || v.Items == nil {
-		return nil
+// runReduceMerged is runReduce with Options.MergeOutput. Like with
+// runReduceGrouped, the merged outputs are sent unless ctx is cancelled and
+// recorded once they are received.
+func (j *job) runReduceMerged(ctx context.Context, accumulator <-chan KeyValue, out chan<- KeyValue) {
+	for _, g := range j.collectGroups(accumulator) {
+		if !j.reserveOutput() {
+			return
+		}
+		v := g.Values[0]
+		for _, b := range g.Values[1:] {
+			v = j.opts.MergeOutput(g.Key, v, b)
+		}
+		select {
+		case out <- KeyValue{g.Key, v}:
+			j.delivered(g.Key, v)
+		case <-ctx.Done():
+			return
+		}
 	}
-	out := make(chan KeyValue)
+}
+
+// collectGroups runs runReducePipeline and returns its outputs grouped by
+// final key, in the order the final keys were first output.
+func (j *job) collectGroups(accumulator <-chan KeyValue) []FinalGroup {
+	outputs := make(chan KeyValue)
+	done := make(chan []FinalGroup)
 	go func() {
-		for _, i := range v.Items {
-			// Creates a pointer to valueType.
-			obj := reflect.New(c.valueType)
-			if err := gob.NewDecoder(bytes.NewBuffer(i.Value)).DecodeValue(obj); err == nil {
-				// reflect.New() returns a *pointer* to type c.valueType, so deference
-				// the pointer here.
-				out <- KeyValue{i.Key, obj.Elem().Interface()}
-			} else {
-				errChan <- fmt.Errorf("failed to decode from cache for key %s: %s", key, err)
+		var groups []FinalGroup
+		index := map[string]int{}
+		for kv := range outputs {
+			i, ok := index[kv.Key]
+			if !ok {
+				i = len(groups)
+				index[kv.Key] = i
+				groups = append(groups, FinalGroup{Key: kv.Key})
 			}
+			groups[i].Values = append(groups[i].Values, kv.Value)
 		}
-		close(out)
+		done <- groups
 	}()
-	return out
+	j.runReducePipeline(accumulator, outputs)
+	close(outputs)
+	return <-done
 }
 
-func (c *MappingCache) add(mapKey, reduceKey string, v interface{}, errChan chan<- error) {
-	buf := bytes.Buffer{}
-	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
-		errChan <- fmt.Errorf("failed to encode to cache key %s: %s", mapKey, err)
-		return
+// seedValue is a value to send to a reducer.
+type seedValue struct {
+	io *reduceIO
+	v  interface{}
+}
+
+// seed sends v to the reducer of io.
+func (j *job) seed(io *reduceIO, v interface{}) {
+	defer j.releaseValue()
+	if p := j.perf; p != nil {
+		atomic.AddInt64(&p.seedsInFlight, 1)
+		defer atomic.AddInt64(&p.seedsInFlight, -1)
+	}
+	select {
+	case io.reducerInput <- v:
+	case <-j.ctx.Done():
+	}
+}
+
+// forward sends the emitted values straight to out, for Options.MapOnly.
+func (j *job) forward(accumulator <-chan KeyValue, out chan<- KeyValue) {
+	// The outputs go through a reduceIO so the output options still apply.
+	r := j.newReduceIO("", out)
+	r.forward = true
+	for {
+		var kp KeyValue
+		ok := false
+		select {
+		case kp, ok = <-accumulator:
+		case <-j.ctx.Done():
+		}
+		if !ok {
+			break
+		}
+		r.send(kp.Key, kp.Value)
+	}
+}
+
+// drain reads accumulator until it is closed and returns a closed channel
+// buffering all the values read.
+func (j *job) drain(accumulator <-chan KeyValue) <-chan KeyValue {
+	var values []KeyValue
+	for {
+		var kp KeyValue
+		ok := false
+		select {
+		case kp, ok = <-accumulator:
+		case <-j.ctx.Done():
+		}
+		if !ok {
+			break
+		}
+		values = append(values, kp)
+	}
+	c := make(chan KeyValue, len(values))
+	for _, kp := range values {
+		c <- kp
 	}
-	item := serializedKeyValue{reduceKey, buf.Bytes()}
+	close(c)
+	return c
+}
+
+// runReduceSerial is runReduce with Options.SerialReduce. It groups all the
+// values first, then runs the reducers one at a time in reduce key order.
+func (j *job) runReduceSerial(accumulator <-chan KeyValue, out chan<- KeyValue) {
+	groups := j.group(accumulator)
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if j.ctx.Err() != nil {
+			return
+		}
+		j.reduceGroup(k, groups[k], out)
+	}
+}
 
-	c.lock.Lock()
-	defer c.lock.Unlock()
-	if c.Data[mapKey] == nil {
-		c.Data[mapKey] = &cacheValues{Items: make([]serializedKeyValue, 0, 1)}
+// group reads accumulator until it is closed and returns the values grouped
+// by group key.
+func (j *job) group(accumulator <-chan KeyValue) map[string][]interface{} {
+	groups := map[string][]interface{}{}
+	for {
+		var kp KeyValue
+		ok := false
+		select {
+		case kp, ok = <-accumulator:
+		case <-j.ctx.Done():
+		}
+		if !ok {
+			break
+		}
+		groupKey := j.groupKey(kp.Key)
+		groups[groupKey] = append(groups[groupKey], kp.Value)
+		if p := j.perf; p != nil {
+			p.addReduceValue(int64(len(groups[groupKey])))
+		}
+	}
+	return groups
+}
+
+// reduceGroup runs the reducer for reduceKey over all its values, or replays
+// its outputs from Options.ReduceCache.
+func (j *job) reduceGroup(reduceKey string, values []interface{}, out chan<- KeyValue) {
+	h := ""
+	if c := j.opts.ReduceCache; c != nil {
+		var ok bool
+		if h, ok = j.replayReduce(c, reduceKey, values, out); ok {
+			return
+		}
+	}
+	r := j.newReduceIO(reduceKey, out)
+	r.numValues = int64(len(values))
+	r.record = h != ""
+	go func() {
+		defer close(r.reducerInput)
+		for _, v := range values {
+			select {
+			case r.reducerInput <- v:
+			case <-j.ctx.Done():
+				return
+			}
+		}
+	}()
+	// A cancelled run may have cut the reducer short, e.g. with FailFast, so
+	// its outputs may be incomplete.
+	if j.reduce(r) == nil && r.record && j.ctx.Err() == nil {
+		kvs := append([]KeyValue{{reduceHashPrefix + h, nil}}, r.recorded...)
+		if err := j.opts.ReduceCache.Put(reduceKey, kvs); err != nil {
+			j.reportError(err)
+		}
+	}
+}
+
+// cacheKey returns the key of mapKey in the cache, as defined by
+// Options.CacheKeyFunc.
+func (j *job) cacheKey(mapKey string) string {
+	if j.opts.CacheKeyFunc != nil {
+		return j.opts.CacheKeyFunc(mapKey)
+	}
+	return mapKey
+}
+
+// groupKey returns the group of reduceKey, as defined by
+// Options.GroupKeyFunc.
+func (j *job) groupKey(reduceKey string) string {
+	if j.opts.GroupKeyFunc != nil {
+		return j.opts.GroupKeyFunc(reduceKey)
+	}
+	return reduceKey
+}
+
+func (j *job) newReduceIO(reduceKey string, out chan<- KeyValue) *reduceIO {
+	return &reduceIO{
+		j:             j,
+		reduceKey:     reduceKey,
+		reducerInput:  make(chan interface{}),
+		reducerOutput: out,
+	}
+}
+
+// reduce runs the reducer for io.
+func (j *job) reduce(io *reduceIO) error {
+	if p := j.perf; p != nil {
+		atomic.AddInt64(&p.reducersRunning, 1)
+		defer atomic.AddInt64(&p.reducersRunning, -1)
+	}
+	start := j.clock.Now()
+	err := j.callReduce(io)
+	if err != nil {
+		j.reportError(&ReduceError{io.reduceKey, err})
+	}
+	io.flush()
+	if f := j.opts.OnReduceDone; f != nil {
+		f(io.reduceKey, int(atomic.LoadInt64(&io.outputs)), j.clock.Now().Sub(start))
+	}
+	// Drain the values the reducer didn't consume, e.g. when it returned early
+	// with an error, so the seeding doesn't block forever.
+	for range io.reducerInput {
 	}
-	values := c.Data[mapKey]
-	values.dirty = true
-	values.Items = append(values.Items, item)
+	return err
 }
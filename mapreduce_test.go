@@ -5,8 +5,18 @@
 package mapreduce
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
 	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/maruel/ut"
 )
@@ -31,6 +41,18 @@ func (m *mapperImpl) Map(io MapIO) error {
 	return nil
 }
 
+// mapperFailing returns the error associated with the map key, if any, and
+// emits (key.1, 1) otherwise.
+type mapperFailing map[string]error
+
+func (m mapperFailing) Map(io MapIO) error {
+	if err := m[io.MapKey()]; err != nil {
+		return err
+	}
+	io.Emit(io.MapKey()+".1", 1)
+	return nil
+}
+
 func TestMapReduceOne(t *testing.T) {
 	cache := &MappingCache{}
 	cache.SetValueType(0)
@@ -102,7 +124,7 @@ func TestMapReduceErrorEmitCacheType(t *testing.T) {
 	MapReduce(in, out, errChan, cache, nil, &mapperImpl{}, &ReducePassThrough{})
 
 	err := <-errChan
-	ut.AssertEqual(t, "expected type string, got int", err.Error())
+	ut.AssertEqual(t, "failed to map A: expected type string, got int", err.Error())
 
 	i := <-out
 	ut.AssertEqual(t, "A.1", i.Key)
@@ -124,7 +146,7 @@ func TestMapReduceErrorEmitMarshal(t *testing.T) {
 	MapReduce(in, out, errChan, cache, nil, &mapperImpl{returnInterface: true}, &ReducePassThrough{})
 
 	err := <-errChan
-	ut.AssertEqual(t, "expected type int, got chan string", err.Error())
+	ut.AssertEqual(t, "failed to map A: expected type int, got chan string", err.Error())
 
 	i := <-out
 	ut.AssertEqual(t, "A.1", i.Key)
@@ -133,3 +155,944 @@ func TestMapReduceErrorEmitMarshal(t *testing.T) {
 	_, ok = <-out
 	ut.AssertEqual(t, false, ok)
 }
+
+type mapperMulti struct {
+}
+
+func (m *mapperMulti) Map(io MapIO) error {
+	for i := 1; i <= 3; i++ {
+		io.Emit(io.MapKey(), i)
+	}
+	io.Emit("all", 10)
+	return nil
+}
+
+// reducerTotal emits a single aggregated output once ReduceValues() is closed.
+type reducerTotal struct {
+}
+
+func (r *reducerTotal) Reduce(io ReduceIO) error {
+	total := 0
+	for v := range io.ReduceValues() {
+		total += v.(int)
+	}
+	io.Output(io.ReduceKey(), total)
+	return nil
+}
+
+func TestMapReduceReduceAfterClose(t *testing.T) {
+	out := make(chan KeyValue)
+	in := make(chan string)
+	go func() {
+		in <- "A"
+		in <- "B"
+		close(in)
+	}()
+	go MapReduce(in, out, make(chan error), nil, nil, &mapperMulti{}, &reducerTotal{})
+
+	actual := map[string]int{}
+	for i := range out {
+		_, ok := actual[i.Key]
+		ut.AssertEqual(t, false, ok)
+		actual[i.Key] = i.Value.(int)
+	}
+	ut.AssertEqual(t, map[string]int{"A": 6, "B": 6, "all": 20}, actual)
+}
+
+type mapperBytes struct {
+	t *testing.T
+}
+
+func (m *mapperBytes) Map(io MapIO) error {
+	if m.t != nil {
+		m.t.Fatal("This wasn't expected")
+	}
+	io.Emit(io.MapKey(), len(io.MapKeyBytes()))
+	return nil
+}
+
+func TestMapReduceBinaryKey(t *testing.T) {
+	key := "a\x00b\xff\xfe"
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	out := make(chan KeyValue, 1)
+	MapReduce(GeneratorFromSlice([]string{key}), out, make(chan error), cache, nil, &mapperBytes{}, &ReducePassThrough{})
+	ut.AssertEqual(t, KeyValue{key, 5}, <-out)
+
+	// Round trip the cache through gob, the key must be preserved byte for byte.
+	buf := bytes.Buffer{}
+	ut.AssertEqual(t, nil, gob.NewEncoder(&buf).Encode(cache))
+	loaded := &MappingCache{}
+	ut.AssertEqual(t, nil, gob.NewDecoder(&buf).Decode(loaded))
+	loaded.SetValueType(0)
+	_, ok := loaded.Data[key]
+	ut.AssertEqual(t, true, ok)
+
+	perf := &PerfStats{}
+	out = make(chan KeyValue, 1)
+	MapReduce(GeneratorFromSlice([]string{key}), out, make(chan error), loaded, perf, &mapperBytes{t: t}, &ReducePassThrough{})
+	ut.AssertEqual(t, KeyValue{key, 5}, <-out)
+	ut.AssertEqual(t, 1, perf.CacheHits())
+}
+
+type mapperSequence struct {
+}
+
+func (m *mapperSequence) Map(io MapIO) error {
+	for i := 0; i < 100; i++ {
+		io.Emit(io.MapKey(), i)
+	}
+	return nil
+}
+
+// reducerSequence outputs whether the values were received in increasing
+// order.
+type reducerSequence struct {
+}
+
+func (r *reducerSequence) Reduce(io ReduceIO) error {
+	last := -1
+	ordered := true
+	for v := range io.ReduceValues() {
+		if v.(int) != last+1 {
+			ordered = false
+		}
+		last = v.(int)
+	}
+	io.Output(io.ReduceKey(), ordered && last == 99)
+	return nil
+}
+
+func TestMapReduceOrderedValues(t *testing.T) {
+	keys := []string{}
+	for i := 0; i < 20; i++ {
+		keys = append(keys, string(rune('A'+i)))
+	}
+	out := make(chan KeyValue)
+	go MapReduceWithOptions(GeneratorFromSlice(keys), out, make(chan error), nil, nil, &mapperSequence{}, &reducerSequence{}, &Options{OrderedValues: true})
+	count := 0
+	for i := range out {
+		ut.AssertEqual(t, true, i.Value)
+		count++
+	}
+	ut.AssertEqual(t, len(keys), count)
+}
+
+func TestMapReduceMaxOutput(t *testing.T) {
+	// The generator never ends, MaxOutput is what stops the run.
+	in := make(chan string)
+	stop := make(chan struct{})
+	go func() {
+		defer close(in)
+		for i := 0; ; i++ {
+			select {
+			case in <- string(rune('A' + i%26)):
+			case <-stop:
+				return
+			}
+		}
+	}()
+	out := make(chan KeyValue)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		MapReduceWithOptions(in, out, make(chan error), nil, nil, &mapperSequence{}, &ReducePassThrough{}, &Options{MaxOutput: 3})
+	}()
+	count := 0
+	for range out {
+		count++
+	}
+	<-done
+	close(stop)
+	ut.AssertEqual(t, 3, count)
+}
+
+func TestMapReduceContextConsumerStopped(t *testing.T) {
+	// The consumer of out reads a single item then stops; cancelling ctx must
+	// unblock every pending Output.
+	ctx, cancel := context.WithCancel(context.Background())
+	out := make(chan KeyValue)
+	done := make(chan error)
+	go func() {
+		done <- MapReduceContext(ctx, GeneratorFromSlice([]string{"A", "B", "C"}), out, make(chan error), nil, nil, &mapperSequence{}, &ReducePassThrough{}, nil)
+	}()
+	<-out
+	cancel()
+	ut.AssertEqual(t, context.Canceled, <-done)
+	// out is closed once the run returns.
+	for range out {
+	}
+}
+
+// contextKey is the key of the run-scoped value read by mapperContext.
+type contextKey struct {
+}
+
+// mapperContext emits the run-scoped value found in the context of the run.
+type mapperContext struct {
+}
+
+func (m *mapperContext) Map(io MapIO) error {
+	io.Emit(io.MapKey(), io.Context().Value(contextKey{}))
+	return nil
+}
+
+func TestMapIOContext(t *testing.T) {
+	ctx := context.WithValue(context.Background(), contextKey{}, "token")
+	out := make(chan KeyValue, 2)
+	err := MapReduceContext(ctx, GeneratorFromSlice([]string{"A", "B"}), out, nil, nil, nil, &mapperContext{}, &ReducePassThrough{}, nil)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, map[string]interface{}{"A": "token", "B": "token"}, collectMap(out))
+}
+
+// reducerConstant outputs a single constant final key, whatever the reduce
+// key is.
+type reducerConstant struct {
+}
+
+func (r *reducerConstant) Reduce(io ReduceIO) error {
+	for range io.ReduceValues() {
+	}
+	io.Output("constant", io.ReduceKey())
+	return nil
+}
+
+func TestMapReduceDetectDuplicateOutput(t *testing.T) {
+	errChan := make(chan error, 2)
+	out := make(chan KeyValue, 2)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A", "B"}), out, errChan, nil, nil, &mapperImpl{}, &reducerConstant{}, &Options{DetectDuplicateOutput: true})
+	ut.AssertEqual(t, 2, len(out))
+	ut.AssertEqual(t, 1, len(errChan))
+	ut.AssertEqual(t, "final key constant was output more than once", (<-errChan).Error())
+
+	// Off by default.
+	errChan = make(chan error, 2)
+	out = make(chan KeyValue, 2)
+	MapReduce(GeneratorFromSlice([]string{"A", "B"}), out, errChan, nil, nil, &mapperImpl{}, &reducerConstant{})
+	ut.AssertEqual(t, 2, len(out))
+	ut.AssertEqual(t, 0, len(errChan))
+}
+
+// reducerNumValues outputs NumValues() once ReduceValues() is closed.
+type reducerNumValues struct {
+}
+
+func (r *reducerNumValues) Reduce(io ReduceIO) error {
+	count := 0
+	for range io.ReduceValues() {
+		count++
+		if io.NumValues() < count {
+			return errors.New("NumValues() is not a lower bound")
+		}
+	}
+	if io.NumValues() != count {
+		return errors.New("NumValues() is not exact")
+	}
+	io.Output(io.ReduceKey(), io.NumValues())
+	return nil
+}
+
+func TestMapReduceNumValues(t *testing.T) {
+	results, errs := RunInMemory([]string{"A", "B"}, &mapperMulti{}, &reducerNumValues{})
+	ut.AssertEqual(t, 0, len(errs))
+	actual := map[string]interface{}{}
+	for _, i := range results {
+		actual[i.Key] = i.Value
+	}
+	ut.AssertEqual(t, map[string]interface{}{"A": 3, "B": 3, "all": 2}, actual)
+}
+
+func TestMapReduceNilErrChan(t *testing.T) {
+	out := make(chan KeyValue, 1)
+	MapReduce(GeneratorFromSlice([]string{"A", "B"}), out, nil, nil, nil, &mapperImpl{err: errors.New("Oh")}, &ReducePassThrough{})
+	_, ok := <-out
+	ut.AssertEqual(t, false, ok)
+}
+
+func TestJobReportErrorPanic(t *testing.T) {
+	// The panic happens in the mapper goroutine so it can't be tested through
+	// MapReduce.
+	j := &job{opts: Options{PanicOnError: true}}
+	defer func() {
+		ut.AssertEqual(t, "Oh", recover().(error).Error())
+	}()
+	j.reportError(errors.New("Oh"))
+	t.Fatal("expected panic")
+}
+
+type mapperCase struct {
+}
+
+func (m *mapperCase) Map(io MapIO) error {
+	io.Emit(io.MapKey(), 1)
+	io.Emit(strings.ToLower(io.MapKey()), 2)
+	return nil
+}
+
+func TestMapReduceGroupKeyFunc(t *testing.T) {
+	out := make(chan KeyValue)
+	go MapReduceWithOptions(GeneratorFromSlice([]string{"A", "B"}), out, make(chan error), nil, nil, &mapperCase{}, &reducerTotal{}, &Options{GroupKeyFunc: strings.ToLower})
+	ut.AssertEqual(t, map[string]interface{}{"a": 3, "b": 3}, collectMap(out))
+
+	out = make(chan KeyValue)
+	go MapReduceWithOptions(GeneratorFromSlice([]string{"A", "B"}), out, make(chan error), nil, nil, &mapperCase{}, &reducerTotal{}, &Options{GroupKeyFunc: strings.ToLower, SerialReduce: true})
+	ut.AssertEqual(t, map[string]interface{}{"a": 3, "b": 3}, collectMap(out))
+}
+
+func TestMapReduceFailFast(t *testing.T) {
+	// The generator never ends, the first error is what stops the run.
+	in := make(chan string)
+	stop := make(chan struct{})
+	go func() {
+		defer close(in)
+		for {
+			select {
+			case in <- "A":
+			case <-stop:
+				return
+			}
+		}
+	}()
+	defer close(stop)
+	errChan := make(chan error, 1)
+	oh := errors.New("Oh")
+	err := MapReduceContext(context.Background(), in, make(chan KeyValue), errChan, nil, nil, &mapperImpl{err: oh}, &ReducePassThrough{}, &Options{FailFast: true})
+	ut.AssertEqual(t, "failed to map A: Oh", err.Error())
+	ut.AssertEqual(t, "failed to map A: Oh", (<-errChan).Error())
+}
+
+func TestMapReduceIsFatal(t *testing.T) {
+	isFatal := func(err error) bool {
+		var typeErr *TypeMismatchError
+		return errors.As(err, &typeErr)
+	}
+	// A transient error doesn't stop the run.
+	errChan := make(chan error, 2)
+	oh := errors.New("Oh")
+	err := MapReduceContext(context.Background(), GeneratorFromSlice([]string{"A", "B"}), make(chan KeyValue), errChan, nil, nil, &mapperImpl{err: oh}, &ReducePassThrough{}, &Options{IsFatal: isFatal})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 2, len(errChan))
+
+	// The generator never ends, the fatal error is what stops the run.
+	in := make(chan string)
+	stop := make(chan struct{})
+	go func() {
+		defer close(in)
+		for {
+			select {
+			case in <- "A":
+			case <-stop:
+				return
+			}
+		}
+	}()
+	defer close(stop)
+	errChan = make(chan error, 1)
+	err = MapReduceContext(context.Background(), in, make(chan KeyValue, 1), errChan, nil, nil, &mapperImpl{}, &ReducePassThrough{}, &Options{IsFatal: isFatal, ExpectValueType: ""})
+	ut.AssertEqual(t, "failed to map A: expected type string, got int", err.Error())
+	ut.AssertEqual(t, err, <-errChan)
+}
+
+func TestMapReduceMaxErrors(t *testing.T) {
+	// The generator never ends, the errors are what stop the run.
+	in := make(chan string)
+	stop := make(chan struct{})
+	go func() {
+		defer close(in)
+		for i := 0; ; i++ {
+			select {
+			case in <- string(rune('A' + i%26)):
+			case <-stop:
+				return
+			}
+		}
+	}()
+	defer close(stop)
+	errChan := make(chan error, 100)
+	oh := errors.New("Oh")
+	opts := &Options{MaxErrors: 3}
+	err := MapReduceContext(context.Background(), in, make(chan KeyValue), errChan, nil, nil, &mapperImpl{err: oh}, &ReducePassThrough{}, opts)
+	ut.AssertEqual(t, true, strings.HasPrefix(err.Error(), "stopped after "))
+	ut.AssertEqual(t, true, errors.Is(err, oh))
+	// A mapper may start before the run is cancelled.
+	ut.AssertEqual(t, true, len(errChan) >= 4)
+}
+
+// mapperGatedFailure emits (key.1, 1) except for the key "B", which fails
+// once release is closed.
+type mapperGatedFailure struct {
+	release chan struct{}
+}
+
+func (m *mapperGatedFailure) Map(io MapIO) error {
+	if io.MapKey() == "B" {
+		<-m.release
+		return errors.New("Oh")
+	}
+	io.Emit(io.MapKey()+".1", 1)
+	return nil
+}
+
+func TestMapReduceFailFastPartialResults(t *testing.T) {
+	out := make(chan KeyValue)
+	errChan := make(chan error, 1)
+	mapper := &mapperGatedFailure{release: make(chan struct{})}
+	done := make(chan error)
+	go func() {
+		done <- MapReduceContext(context.Background(), GeneratorFromSlice([]string{"A", "B"}), out, errChan, nil, nil, mapper, &ReducePassThrough{}, &Options{FailFast: true})
+	}()
+	// A's output is received before B fails.
+	ut.AssertEqual(t, KeyValue{"A.1", 1}, <-out)
+	close(mapper.release)
+	_, ok := <-out
+	ut.AssertEqual(t, false, ok)
+	ut.AssertEqual(t, "failed to map B: Oh", (<-done).Error())
+	ut.AssertEqual(t, "failed to map B: Oh", (<-errChan).Error())
+}
+
+type mapperBatch struct {
+	t *testing.T
+}
+
+func (m *mapperBatch) Map(io MapIO) error {
+	if m.t != nil {
+		m.t.Fatal("This wasn't expected")
+	}
+	io.EmitBatch([]KeyValue{{"a", 1}, {"b", 2}, {"a", 3}})
+	return nil
+}
+
+func TestMapReduceEmitBatch(t *testing.T) {
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	expected := map[string]interface{}{"a": 4, "b": 2}
+	out := make(chan KeyValue)
+	go MapReduce(GeneratorFromSlice([]string{"A"}), out, nil, cache, nil, &mapperBatch{}, &reducerTotal{})
+	ut.AssertEqual(t, expected, collectMap(out))
+	ut.AssertEqual(t, 3, len(cache.Data["A"].Items))
+
+	perf := &PerfStats{}
+	out = make(chan KeyValue)
+	go MapReduce(GeneratorFromSlice([]string{"A"}), out, nil, cache, perf, &mapperBatch{t: t}, &reducerTotal{})
+	ut.AssertEqual(t, expected, collectMap(out))
+	ut.AssertEqual(t, 1, perf.CacheHits())
+}
+
+func TestMapReduceEmitBatchType(t *testing.T) {
+	cache := &MappingCache{}
+	cache.SetValueType("")
+	errChan := make(chan error, 3)
+	MapReduce(GeneratorFromSlice([]string{"A"}), make(chan KeyValue, 3), errChan, cache, nil, &mapperBatch{}, &ReducePassThrough{})
+	// Every element is validated.
+	ut.AssertEqual(t, 3, len(errChan))
+	ut.AssertEqual(t, "failed to map A: expected type string, got int", (<-errChan).Error())
+}
+
+// reducerShared appends to a shared slice without locking and records the
+// maximum number of concurrent reducers seen.
+type reducerShared struct {
+	perf  *PerfStats
+	keys  []string
+	maxed int
+}
+
+func (r *reducerShared) Reduce(io ReduceIO) error {
+	for range io.ReduceValues() {
+	}
+	if n := r.perf.ReducersRunning(); n > r.maxed {
+		r.maxed = n
+	}
+	r.keys = append(r.keys, io.ReduceKey())
+	return nil
+}
+
+func TestMapReduceSerialReduce(t *testing.T) {
+	perf := &PerfStats{}
+	reducer := &reducerShared{perf: perf}
+	MapReduceWithOptions(GeneratorFromSlice([]string{"C", "A", "B"}), make(chan KeyValue), nil, nil, perf, &mapperMulti{}, reducer, &Options{SerialReduce: true})
+	ut.AssertEqual(t, []string{"A", "B", "C", "all"}, reducer.keys)
+	ut.AssertEqual(t, 1, reducer.maxed)
+	ut.AssertEqual(t, 0, perf.ReducersRunning())
+}
+
+func TestPerfStatsSnapshot(t *testing.T) {
+	perf := &PerfStats{}
+	mapper := &mapperRecord{release: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		MapReduce(GeneratorFromSlice([]string{"A"}), make(chan KeyValue), nil, nil, perf, mapper, &ReducePassThrough{})
+	}()
+	// Poll while the mapper is blocked.
+	for perf.Snapshot().CacheMisses != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	ut.AssertEqual(t, Stats{MappersRunning: 1, CacheMisses: 1}, perf.Snapshot())
+	close(mapper.release)
+	<-done
+	ut.AssertEqual(t, Stats{CacheMisses: 1}, perf.Snapshot())
+}
+
+func TestMapReduceProgress(t *testing.T) {
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	ut.AssertEqual(t, nil, cache.Put("A", []KeyValue{{"A.1", 1}}))
+	progress := make(chan ProgressEvent, 2)
+	mapper := mapperFailing{"B": errors.New("Oh")}
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A", "B"}), make(chan KeyValue, 1), nil, cache, nil, mapper, &ReducePassThrough{}, &Options{Progress: progress})
+	actual := map[string]ProgressEvent{}
+	for len(progress) != 0 {
+		e := <-progress
+		actual[e.MapKey] = e
+	}
+	ut.AssertEqual(t, ProgressEvent{MapKey: "A", FromCache: true}, actual["A"])
+	ut.AssertEqual(t, "failed to map B: Oh", actual["B"].Err.Error())
+	ut.AssertEqual(t, false, actual["B"].FromCache)
+}
+
+func TestPerfStatsOutputBlockedDuration(t *testing.T) {
+	perf := &PerfStats{}
+	out := make(chan KeyValue)
+	go MapReduce(GeneratorFromSlice([]string{"A"}), out, nil, nil, perf, &mapperImpl{}, &ReducePassThrough{})
+	// The reducer is blocked until out is read.
+	for perf.ReducersRunning() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	for range out {
+	}
+	ut.AssertEqual(t, true, perf.OutputBlockedDuration() >= 10*time.Millisecond)
+	ut.AssertEqual(t, perf.OutputBlockedDuration(), perf.Snapshot().OutputBlockedDuration)
+}
+
+// reducerCancelled ranges over the values and reports Cancelled() once the
+// channel is closed.
+type reducerCancelled struct {
+	cancelled chan bool
+}
+
+func (r *reducerCancelled) Reduce(io ReduceIO) error {
+	for range io.ReduceValues() {
+	}
+	r.cancelled <- io.Cancelled()
+	return nil
+}
+
+func TestMapReduceCancelledReducer(t *testing.T) {
+	// The generator never ends so ReduceValues() would never be closed
+	// without cancellation.
+	in := make(chan string)
+	stop := make(chan struct{})
+	go func() {
+		defer close(in)
+		for {
+			select {
+			case in <- "A":
+			case <-stop:
+				return
+			}
+		}
+	}()
+	defer close(stop)
+	ctx, cancel := context.WithCancel(context.Background())
+	perf := &PerfStats{}
+	reducer := &reducerCancelled{cancelled: make(chan bool, 1)}
+	done := make(chan error)
+	go func() {
+		done <- MapReduceContext(ctx, in, make(chan KeyValue), nil, nil, perf, &mapperImpl{}, reducer, nil)
+	}()
+	for perf.ReducersRunning() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	ut.AssertEqual(t, context.Canceled, <-done)
+	ut.AssertEqual(t, true, <-reducer.cancelled)
+}
+
+// mapperCounted emits 0..99 and counts the values accepted by Emit.
+type mapperCounted struct {
+	emitted int32
+}
+
+func (m *mapperCounted) Map(io MapIO) error {
+	for i := 0; i < 100; i++ {
+		io.Emit(io.MapKey(), i)
+		atomic.AddInt32(&m.emitted, 1)
+	}
+	return nil
+}
+
+// reducerGated waits for release before counting the values.
+type reducerGated struct {
+	release chan struct{}
+}
+
+func (r *reducerGated) Reduce(io ReduceIO) error {
+	<-r.release
+	count := 0
+	for range io.ReduceValues() {
+		count++
+	}
+	io.Output(io.ReduceKey(), count)
+	return nil
+}
+
+func TestMapReduceMaxBufferedValues(t *testing.T) {
+	out := make(chan KeyValue)
+	mapper := &mapperCounted{}
+	reducer := &reducerGated{release: make(chan struct{})}
+	perf := &PerfStats{}
+	go MapReduceWithOptions(GeneratorFromSlice([]string{"A"}), out, make(chan error), nil, perf, mapper, reducer, &Options{MaxBufferedValues: 5})
+	// Wait for the mapper to block: 5 values are buffered and one more is held
+	// by the accumulator.
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if perf.ReducersRunning() == 1 && perf.SeedsInFlight() == 5 && atomic.LoadInt32(&mapper.emitted) == 6 {
+			break
+		}
+	}
+	ut.AssertEqual(t, 1, perf.ReducersRunning())
+	ut.AssertEqual(t, int32(6), atomic.LoadInt32(&mapper.emitted))
+	ut.AssertEqual(t, 5, perf.SeedsInFlight())
+	close(reducer.release)
+	ut.AssertEqual(t, []KeyValue{{"A", 100}}, Collect(out))
+	ut.AssertEqual(t, int32(100), atomic.LoadInt32(&mapper.emitted))
+	ut.AssertEqual(t, 0, perf.SeedsInFlight())
+}
+
+// mapperOrder emits its map key to "all".
+type mapperOrder struct {
+}
+
+func (m *mapperOrder) Map(io MapIO) error {
+	io.Emit("all", io.MapKey())
+	return nil
+}
+
+// reducerJoin outputs the values joined in reception order.
+type reducerJoin struct {
+}
+
+func (r *reducerJoin) Reduce(io ReduceIO) error {
+	var values []string
+	for v := range io.ReduceValues() {
+		values = append(values, v.(string))
+	}
+	io.Output(io.ReduceKey(), strings.Join(values, ","))
+	return nil
+}
+
+func TestMapReduceDeterministic(t *testing.T) {
+	keys := []string{"C", "A", "E", "B", "D"}
+	for i := 0; i < 10; i++ {
+		out := make(chan KeyValue, 1)
+		MapReduceWithOptions(GeneratorFromSlice(keys), out, nil, nil, nil, &mapperOrder{}, &reducerJoin{}, &Options{Deterministic: true})
+		ut.AssertEqual(t, KeyValue{"all", "C,A,E,B,D"}, <-out)
+	}
+}
+
+func TestPerfStatsValuesPerKey(t *testing.T) {
+	for _, serial := range []bool{false, true} {
+		perf := &PerfStats{}
+		MapReduceWithOptions(GeneratorFromSlice([]string{"A", "B", "C", "D"}), make(chan KeyValue, 5), nil, nil, perf, &mapperMulti{}, &reducerTotal{}, &Options{SerialReduce: serial})
+		// "all" receives one value per map key.
+		ut.AssertEqual(t, 4, perf.MaxValuesPerKey())
+		ut.AssertEqual(t, 5, perf.DistinctReduceKeys())
+	}
+}
+
+// fakeClock advances by step on every call to Now.
+type fakeClock struct {
+	lock sync.Mutex
+	now  time.Time
+	step time.Duration
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.now = f.now.Add(f.step)
+	return f.now
+}
+
+func TestMapReduceClock(t *testing.T) {
+	perf := &PerfStats{}
+	clock := &fakeClock{step: time.Second}
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A", "B"}), make(chan KeyValue, 2), nil, nil, perf, &mapperImpl{}, &ReducePassThrough{}, &Options{Clock: clock})
+	// Each Output call reads the clock twice.
+	ut.AssertEqual(t, 2*time.Second, perf.OutputBlockedDuration())
+}
+
+func TestMapReduceOnReduceDone(t *testing.T) {
+	var lock sync.Mutex
+	var done []string
+	opts := &Options{
+		Clock:         &fakeClock{step: time.Second},
+		Deterministic: true,
+		OnReduceDone: func(reduceKey string, outputs int, d time.Duration) {
+			lock.Lock()
+			defer lock.Unlock()
+			done = append(done, fmt.Sprintf("%s:%d:%s", reduceKey, outputs, d))
+		},
+	}
+	out := make(chan KeyValue, 3)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"a b a"}), out, nil, nil, nil, &mapperWords{}, &ReducePassThrough{}, opts)
+	ut.AssertEqual(t, 3, len(Collect(out)))
+	ut.AssertEqual(t, []string{"a:2:1s", "b:1:1s"}, done)
+}
+
+// mapperSlow emits (key.1, 1) except for the key "slow", which waits for its
+// context to be done and for release to be closed, then emits late.
+type mapperSlow struct {
+	release chan struct{}
+	done    chan struct{}
+}
+
+func (m *mapperSlow) Map(io MapIO) error {
+	if io.MapKey() != "slow" {
+		io.Emit(io.MapKey()+".1", 1)
+		return nil
+	}
+	defer close(m.done)
+	<-io.Context().Done()
+	<-m.release
+	io.Emit("late", 1)
+	return nil
+}
+
+func TestMapReduceMapperTimeout(t *testing.T) {
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	mapper := &mapperSlow{release: make(chan struct{}), done: make(chan struct{})}
+	errChan := make(chan error, 1)
+	out := make(chan KeyValue, 2)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A", "slow"}), out, errChan, cache, nil, mapper, &ReducePassThrough{}, &Options{MapperTimeout: 10 * time.Millisecond})
+	ut.AssertEqual(t, "failed to map slow: timed out after 10ms", (<-errChan).Error())
+	// The late emission of the abandoned call is dropped.
+	close(mapper.release)
+	<-mapper.done
+	ut.AssertEqual(t, []KeyValue{{"A.1", 1}}, Collect(out))
+	ut.AssertEqual(t, []string{"A"}, cachedKeys(cache))
+}
+
+func TestMapReduceGroupedOut(t *testing.T) {
+	grouped := make(chan FinalGroup, 2)
+	out := make(chan KeyValue)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"B", "A", "C"}), out, nil, nil, nil, &mapperImpl{}, &reducerConstant{}, &Options{GroupedOut: grouped, Deterministic: true})
+	ut.AssertEqual(t, 0, len(Collect(out)))
+	var groups []FinalGroup
+	for g := range grouped {
+		groups = append(groups, g)
+	}
+	ut.AssertEqual(t, []FinalGroup{{"constant", []interface{}{"A.1", "B.1", "C.1"}}}, groups)
+}
+
+func TestMapReduceMergeOutput(t *testing.T) {
+	out := make(chan KeyValue, 1)
+	merge := func(key string, a, b interface{}) interface{} {
+		return a.(string) + "+" + b.(string)
+	}
+	MapReduceWithOptions(GeneratorFromSlice([]string{"B", "A", "C"}), out, nil, nil, nil, &mapperImpl{}, &reducerConstant{}, &Options{MergeOutput: merge, Deterministic: true})
+	ut.AssertEqual(t, []KeyValue{{"constant", "A.1+B.1+C.1"}}, Collect(out))
+}
+
+func TestMapReduceRequireEmission(t *testing.T) {
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	out := make(chan KeyValue, 1)
+	errChan := make(chan error, 1)
+	mapper := mapperValues{"A": {1}, "B": nil}
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A", "B"}), out, errChan, cache, nil, mapper, &ReducePassThrough{}, &Options{RequireEmission: true})
+	ut.AssertEqual(t, []KeyValue{{"k", 1}}, Collect(out))
+	ut.AssertEqual(t, "failed to map B: no value emitted", (<-errChan).Error())
+	ut.AssertEqual(t, []string{"A"}, cachedKeys(cache))
+}
+
+// mapperTypes emits values of different types.
+type mapperTypes struct {
+}
+
+func (m *mapperTypes) Map(io MapIO) error {
+	io.Emit("a", 1)
+	io.Emit("b", "bad")
+	io.Emit("c", nil)
+	return nil
+}
+
+func TestMapReduceExpectValueType(t *testing.T) {
+	out := make(chan KeyValue, 3)
+	errChan := make(chan error, 3)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A"}), out, errChan, nil, nil, &mapperTypes{}, &ReducePassThrough{}, &Options{ExpectValueType: 0})
+	ut.AssertEqual(t, []KeyValue{{"a", 1}}, Collect(out))
+	ut.AssertEqual(t, "failed to map A: expected type int, got string", (<-errChan).Error())
+	ut.AssertEqual(t, "failed to map A: expected type int, got <nil>", (<-errChan).Error())
+}
+
+// reducerPhased records the number of mappers running when it starts.
+type reducerPhased struct {
+	perf    *PerfStats
+	lock    sync.Mutex
+	mappers []int
+}
+
+func (r *reducerPhased) Reduce(io ReduceIO) error {
+	r.lock.Lock()
+	r.mappers = append(r.mappers, r.perf.MappersRunning())
+	r.lock.Unlock()
+	total := 0
+	for v := range io.ReduceValues() {
+		total += v.(int)
+	}
+	io.Output(io.ReduceKey(), total)
+	return nil
+}
+
+func TestMapReducePhasedExecution(t *testing.T) {
+	perf := &PerfStats{}
+	reducer := &reducerPhased{perf: perf}
+	out := make(chan KeyValue, 4)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A", "B", "C"}), out, nil, nil, perf, &mapperMulti{}, reducer, &Options{PhasedExecution: true})
+	ut.AssertEqual(t, map[string]interface{}{"A": 6, "B": 6, "C": 6, "all": 30}, collectMap(out))
+	ut.AssertEqual(t, []int{0, 0, 0, 0}, reducer.mappers)
+}
+
+// reducerRepeat outputs its reduce key 10 times.
+type reducerRepeat struct {
+}
+
+func (r *reducerRepeat) Reduce(io ReduceIO) error {
+	for range io.ReduceValues() {
+	}
+	for i := 0; i < 10; i++ {
+		io.Output(io.ReduceKey(), i)
+		time.Sleep(100 * time.Microsecond)
+	}
+	return nil
+}
+
+func TestMapReduceContiguousOutput(t *testing.T) {
+	out := make(chan KeyValue)
+	go MapReduceWithOptions(GeneratorFromSlice([]string{"A", "B", "C", "D"}), out, nil, nil, nil, &mapperMulti{}, &reducerRepeat{}, &Options{ContiguousOutput: true})
+	results := Collect(out)
+	ut.AssertEqual(t, 50, len(results))
+	for i, kv := range results {
+		ut.AssertEqual(t, results[i-i%10].Key, kv.Key)
+		ut.AssertEqual(t, i%10, kv.Value)
+	}
+}
+
+func TestMapReduceMapOnly(t *testing.T) {
+	perf := &PerfStats{}
+	out := make(chan KeyValue, 8)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A", "B"}), out, nil, nil, perf, &mapperMulti{}, nil, &Options{MapOnly: true})
+	results := Collect(out)
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Key != results[j].Key {
+			return results[i].Key < results[j].Key
+		}
+		return results[i].Value.(int) < results[j].Value.(int)
+	})
+	ut.AssertEqual(t, []KeyValue{{"A", 1}, {"A", 2}, {"A", 3}, {"B", 1}, {"B", 2}, {"B", 3}, {"all", 10}, {"all", 10}}, results)
+	ut.AssertEqual(t, 0, perf.DistinctReduceKeys())
+}
+
+func TestMapReduceFeederWorkers(t *testing.T) {
+	keys := []string{"A", "B", "C", "D", "E"}
+	for _, opts := range []*Options{{FeederWorkers: 2}, {FeederWorkers: 1, MaxBufferedValues: 1}} {
+		out := make(chan KeyValue, len(keys)+1)
+		MapReduceWithOptions(GeneratorFromSlice(keys), out, nil, nil, nil, &mapperMulti{}, &reducerTotal{}, opts)
+		ut.AssertEqual(t, map[string]interface{}{"A": 6, "B": 6, "C": 6, "D": 6, "E": 6, "all": 50}, collectMap(out))
+	}
+}
+
+func TestPerfStatsCacheHitRatio(t *testing.T) {
+	perf := &PerfStats{}
+	ut.AssertEqual(t, 0., perf.CacheHitRatio())
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	MapReduce(GeneratorFromSlice([]string{"A"}), make(chan KeyValue, 1), nil, cache, perf, &mapperImpl{}, &ReducePassThrough{})
+	ut.AssertEqual(t, 0., perf.CacheHitRatio())
+	MapReduce(GeneratorFromSlice([]string{"A", "B", "C", "D"}), make(chan KeyValue, 4), nil, cache, perf, &mapperImpl{}, &ReducePassThrough{})
+	ut.AssertEqual(t, 0.2, perf.CacheHitRatio())
+}
+
+func TestMapReduceIntermediateOut(t *testing.T) {
+	intermediate := make(chan KeyValue, 4)
+	out := make(chan KeyValue, 2)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A"}), out, nil, nil, nil, &mapperMulti{}, &reducerTotal{}, &Options{IntermediateOut: intermediate})
+	ut.AssertEqual(t, map[string]interface{}{"A": 6, "all": 10}, collectMap(out))
+	close(intermediate)
+	var values []KeyValue
+	for kv := range intermediate {
+		values = append(values, kv)
+	}
+	ut.AssertEqual(t, []KeyValue{{"A", 1}, {"A", 2}, {"A", 3}, {"all", 10}}, values)
+
+	// A full channel doesn't block the run.
+	intermediate = make(chan KeyValue, 1)
+	out = make(chan KeyValue, 2)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A"}), out, nil, nil, nil, &mapperMulti{}, &reducerTotal{}, &Options{IntermediateOut: intermediate})
+	ut.AssertEqual(t, map[string]interface{}{"A": 6, "all": 10}, collectMap(out))
+	ut.AssertEqual(t, KeyValue{"A", 1}, <-intermediate)
+}
+
+func TestMapReduceEmptyGenerator(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for _, opts := range []*Options{
+		nil,
+		{OrderedValues: true},
+		{SerialReduce: true},
+		{Deterministic: true},
+		{PhasedExecution: true},
+		{MapOnly: true},
+		{FeederWorkers: 2, MaxMappers: 2},
+	} {
+		cache := &MappingCache{}
+		cache.SetValueType(0)
+		perf := &PerfStats{}
+		errChan := make(chan error, 1)
+		in := make(chan string)
+		close(in)
+		out := make(chan KeyValue)
+		MapReduceWithOptions(in, out, errChan, cache, perf, &mapperImpl{t: t}, &ReducePassThrough{}, opts)
+		_, ok := <-out
+		ut.AssertEqual(t, false, ok)
+		ut.AssertEqual(t, 0, len(errChan))
+		ut.AssertEqual(t, Stats{}, perf.Snapshot())
+		ut.AssertEqual(t, CacheStats{}, cacheStats(t, cache))
+	}
+	// No goroutine is leaked.
+	for i := 0; runtime.NumGoroutine() > before; i++ {
+		if i == 100 {
+			t.Fatalf("%d goroutines leaked", runtime.NumGoroutine()-before)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMapReduceAccumulatorBuffer(t *testing.T) {
+	out := make(chan KeyValue)
+	mapper := &mapperCounted{}
+	reducer := &reducerGated{release: make(chan struct{})}
+	perf := &PerfStats{}
+	go MapReduceWithOptions(GeneratorFromSlice([]string{"A"}), out, make(chan error), nil, perf, mapper, reducer, &Options{AccumulatorBuffer: 10, MaxBufferedValues: 5})
+	// Wait for the mapper to block; it is ahead by the buffer size.
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if perf.ReducersRunning() == 1 && atomic.LoadInt32(&mapper.emitted) == 16 {
+			break
+		}
+	}
+	ut.AssertEqual(t, 1, perf.ReducersRunning())
+	ut.AssertEqual(t, int32(16), atomic.LoadInt32(&mapper.emitted))
+	close(reducer.release)
+	ut.AssertEqual(t, []KeyValue{{"A", 100}}, Collect(out))
+}
+
+func TestMapReduceMergeOutputMaxOutput(t *testing.T) {
+	// MaxOutput limits the number of merged KeyValues, not the outputs merged.
+	out := make(chan KeyValue, 3)
+	merge := func(key string, a, b interface{}) interface{} {
+		return a.(int) + b.(int)
+	}
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A", "B"}), out, nil, nil, nil, &mapperMulti{}, &ReducePassThrough{}, &Options{MergeOutput: merge, MaxOutput: 2, Deterministic: true})
+	ut.AssertEqual(t, []KeyValue{{"A", 6}, {"B", 6}}, Collect(out))
+}
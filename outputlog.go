@@ -0,0 +1,104 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// OutputLog is an append-only log of the final keys sent to out. Set it as
+// Options.OutputLog so a resumed run skips the final keys that an interrupted
+// run already output.
+//
+// Like the cache log, records are written without calling fsync.
+type OutputLog struct {
+	lock   sync.Mutex
+	loaded map[string]bool // Final keys recorded when the log was opened; read-only.
+	done   map[string]bool // Final keys recorded, including by the current run.
+	f      *os.File
+}
+
+// OpenOutputLog opens the output log at path, creating it if needed, and
+// loads the final keys already recorded in it. A truncated last record, as left
+// by a crash, is discarded.
+func OpenOutputLog(path string) (*OutputLog, error) {
+	o := &OutputLog{done: map[string]bool{}}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		var size uint32
+		if err = binary.Read(r, binary.BigEndian, &size); err != nil {
+			break
+		}
+		buf := make([]byte, size)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			break
+		}
+		o.done[string(buf)] = true
+		offset += 4 + int64(size)
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// Drop any partial record so new records are appended after the last
+		// complete one.
+		err = f.Truncate(offset)
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	o.loaded = make(map[string]bool, len(o.done))
+	for k := range o.done {
+		o.loaded[k] = true
+	}
+	o.f = f
+	return o, nil
+}
+
+// Close closes the log.
+func (o *OutputLog) Close() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.f.Close()
+}
+
+// Len returns the number of final keys recorded.
+func (o *OutputLog) Len() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return len(o.done)
+}
+
+// has returns true if finalKey was output before the log was opened. The
+// final keys output since are not considered, so a reducer can output the
+// same final key multiple times.
+func (o *OutputLog) has(finalKey string) bool {
+	return o.loaded[finalKey]
+}
+
+// add records that finalKey was output. It is recorded once.
+func (o *OutputLog) add(finalKey string) error {
+	b := make([]byte, 4+len(finalKey))
+	binary.BigEndian.PutUint32(b, uint32(len(finalKey)))
+	copy(b[4:], finalKey)
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.done[finalKey] {
+		return nil
+	}
+	o.done[finalKey] = true
+	if _, err := o.f.Write(b); err != nil {
+		return fmt.Errorf("failed to write output log record for key %s: %s", finalKey, err)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func TestOutputLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "output.log")
+	l, err := OpenOutputLog(path)
+	ut.AssertEqual(t, nil, err)
+	out := make(chan KeyValue, 3)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A", "B"}), out, nil, nil, nil, &mapperMulti{}, &reducerTotal{}, &Options{OutputLog: l})
+	ut.AssertEqual(t, map[string]interface{}{"A": 6, "B": 6, "all": 20}, collectMap(out))
+	ut.AssertEqual(t, nil, l.Close())
+
+	// Simulate a crash while writing a record.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	ut.AssertEqual(t, nil, err)
+	_, err = f.Write([]byte{0, 0, 0, 9, 'C'})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, f.Close())
+
+	// The resumed run only outputs the new final key.
+	l, err = OpenOutputLog(path)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 3, l.Len())
+	out = make(chan KeyValue, 4)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A", "B", "C"}), out, nil, nil, nil, &mapperMulti{}, &reducerTotal{}, &Options{OutputLog: l})
+	ut.AssertEqual(t, map[string]interface{}{"C": 6}, collectMap(out))
+	ut.AssertEqual(t, 4, l.Len())
+	ut.AssertEqual(t, nil, l.Close())
+
+	l, err = OpenOutputLog(path)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 4, l.Len())
+	ut.AssertEqual(t, nil, l.Close())
+}
+
+func TestOutputLogSameFinalKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "output.log")
+	l, err := OpenOutputLog(path)
+	ut.AssertEqual(t, nil, err)
+	// All the values of a reduce key are output with the same final key.
+	mapper := mapperValues{"A": {1, 2, 3}}
+	out := make(chan KeyValue, 3)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A"}), out, nil, nil, nil, mapper, &ReducePassThrough{}, &Options{OutputLog: l, Deterministic: true})
+	ut.AssertEqual(t, []KeyValue{{"k", 1}, {"k", 2}, {"k", 3}}, Collect(out))
+	ut.AssertEqual(t, 1, l.Len())
+	ut.AssertEqual(t, nil, l.Close())
+
+	l, err = OpenOutputLog(path)
+	ut.AssertEqual(t, nil, err)
+	out = make(chan KeyValue, 3)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A"}), out, nil, nil, nil, mapper, &ReducePassThrough{}, &Options{OutputLog: l, Deterministic: true})
+	ut.AssertEqual(t, 0, len(Collect(out)))
+	ut.AssertEqual(t, nil, l.Close())
+}
+
+func TestOutputLogMergeOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "output.log")
+	l, err := OpenOutputLog(path)
+	ut.AssertEqual(t, nil, err)
+	mapper := mapperValues{"A": {1, 2}}
+	merging := make(chan struct{})
+	merge := func(key string, a, b interface{}) interface{} {
+		close(merging)
+		return a.(int) + b.(int)
+	}
+	// Cancel the run while the merged KeyValue is pending on out. It was never
+	// received so it is not recorded.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- MapReduceContext(ctx, GeneratorFromSlice([]string{"A"}), make(chan KeyValue), nil, nil, nil, mapper, &ReducePassThrough{}, &Options{OutputLog: l, MergeOutput: merge})
+	}()
+	<-merging
+	cancel()
+	ut.AssertEqual(t, context.Canceled, <-done)
+	ut.AssertEqual(t, 0, l.Len())
+
+	// The resumed run outputs it.
+	merge = func(key string, a, b interface{}) interface{} {
+		return a.(int) + b.(int)
+	}
+	out := make(chan KeyValue, 1)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A"}), out, nil, nil, nil, mapper, &ReducePassThrough{}, &Options{OutputLog: l, MergeOutput: merge})
+	ut.AssertEqual(t, []KeyValue{{"k", 3}}, Collect(out))
+	ut.AssertEqual(t, 1, l.Len())
+	ut.AssertEqual(t, nil, l.Close())
+}
@@ -0,0 +1,92 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// runReduceCached is runReduce with Options.ReduceCache. It groups all the
+// values first, then runs the reducers concurrently.
+func (j *job) runReduceCached(accumulator <-chan KeyValue, out chan<- KeyValue) {
+	var wg sync.WaitGroup
+	for k, values := range j.group(accumulator) {
+		wg.Add(1)
+		go func(k string, values []interface{}) {
+			defer wg.Done()
+			if !j.acquireReducer() {
+				return
+			}
+			defer j.releaseReducer()
+			j.reduceGroup(k, values, out)
+		}(k, values)
+	}
+	wg.Wait()
+}
+
+// reduceHashPrefix prefixes the hash of the values in the key of the first
+// KeyValue of a ReduceCache entry.
+const reduceHashPrefix = "\x00"
+
+// replayReduce outputs the cached outputs of the reducer for reduceKey and
+// values, if any, and returns true. Otherwise it returns the hash of values to
+// cache the outputs with, or "" if they can't be cached.
+func (j *job) replayReduce(c *MappingCache, reduceKey string, values []interface{}, out chan<- KeyValue) (string, bool) {
+	h, err := hashValues(values)
+	if err != nil {
+		j.reportError(fmt.Errorf("failed to hash the values of %s: %s", reduceKey, err))
+		return "", false
+	}
+	kvs := c.get(reduceKey, j.clock, j.reportError)
+	if len(kvs) == 0 || kvs[0].Key != reduceHashPrefix+h || kvs[0].Value != nil {
+		// Not cached or cached for other values.
+		return h, false
+	}
+	r := j.newReduceIO(reduceKey, out)
+	close(r.reducerInput)
+	for _, kv := range kvs[1:] {
+		r.Output(kv.Key, kv.Value)
+	}
+	r.flush()
+	return h, true
+}
+
+// hashValues returns a hash of values that doesn't depend on their order.
+func hashValues(values []interface{}) (string, error) {
+	encoded := make([][]byte, 0, len(values))
+	for _, v := range values {
+		// Include the type since gob encodes e.g. int and int64 the same way.
+		buf := bytes.Buffer{}
+		if v == nil {
+			buf.WriteString(nilTypeTag)
+		} else {
+			buf.WriteString(typeTag(reflect.TypeOf(v)))
+			buf.WriteByte(0)
+			b, err := gobEncode(v)
+			if err != nil {
+				return "", err
+			}
+			buf.Write(b)
+		}
+		encoded = append(encoded, buf.Bytes())
+	}
+	sort.Slice(encoded, func(i, j int) bool { return bytes.Compare(encoded[i], encoded[j]) < 0 })
+	h := sha256.New()
+	var size [8]byte
+	for _, b := range encoded {
+		// Prefix each value with its size so the concatenation is unambiguous.
+		binary.BigEndian.PutUint64(size[:], uint64(len(b)))
+		h.Write(size[:])
+		h.Write(b)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maruel/ut"
+)
+
+// reducerCounted is reducerTotal counting its calls.
+type reducerCounted struct {
+	lock  sync.Mutex
+	calls []string
+}
+
+func (r *reducerCounted) Reduce(io ReduceIO) error {
+	r.lock.Lock()
+	r.calls = append(r.calls, io.ReduceKey())
+	r.lock.Unlock()
+	return (&reducerTotal{}).Reduce(io)
+}
+
+func TestMapReduceReduceCache(t *testing.T) {
+	for _, serial := range []bool{false, true} {
+		cache := &MappingCache{}
+		cache.SetValueType(0)
+		reducer := &reducerCounted{}
+		opts := &Options{ReduceCache: cache, SerialReduce: serial}
+		out := make(chan KeyValue, 3)
+		MapReduceWithOptions(GeneratorFromSlice([]string{"A", "B"}), out, nil, nil, nil, &mapperMulti{}, reducer, opts)
+		ut.AssertEqual(t, map[string]interface{}{"A": 6, "B": 6, "all": 20}, collectMap(out))
+		ut.AssertEqual(t, 3, len(reducer.calls))
+
+		// Only the reducers whose values changed run again.
+		reducer = &reducerCounted{}
+		out = make(chan KeyValue, 4)
+		MapReduceWithOptions(GeneratorFromSlice([]string{"B", "A", "C"}), out, nil, nil, nil, &mapperMulti{}, reducer, opts)
+		ut.AssertEqual(t, map[string]interface{}{"A": 6, "B": 6, "C": 6, "all": 30}, collectMap(out))
+		reducer.lock.Lock()
+		ut.AssertEqual(t, 2, len(reducer.calls))
+		reducer.lock.Unlock()
+		// The entry of all was replaced instead of accumulating.
+		ut.AssertEqual(t, 4, cacheStats(t, cache).Entries)
+		kvs, _, err := cache.GetKey("all")
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, KeyValue{"all", 30}, kvs[len(kvs)-1])
+		ut.AssertEqual(t, 2, len(kvs))
+
+		// The entries of the reduce keys no longer produced are dropped.
+		n, err := cache.Compact([]string{"A", "B", "all"})
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, 1, n)
+	}
+}
+
+// reducerFailB fails the reduce key B and holds the others until release is
+// closed.
+type reducerFailB struct {
+	release chan struct{}
+}
+
+func (r *reducerFailB) Reduce(io ReduceIO) error {
+	if io.ReduceKey() == "B" {
+		return errors.New("oh")
+	}
+	<-r.release
+	return (&reducerTotal{}).Reduce(io)
+}
+
+func TestMapReduceReduceCacheFailFast(t *testing.T) {
+	// The reducers cut short by FailFast are not cached.
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	reducer := &reducerFailB{release: make(chan struct{})}
+	opts := &Options{
+		ReduceCache: cache,
+		FailFast:    true,
+		// It is called once the run is aborted.
+		OnReduceDone: func(reduceKey string, outputs int, d time.Duration) {
+			if reduceKey == "B" {
+				close(reducer.release)
+			}
+		},
+	}
+	out := make(chan KeyValue, 3)
+	errChan := make(chan error, 1)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A", "B"}), out, errChan, nil, nil, &mapperMulti{}, reducer, opts)
+	ut.AssertEqual(t, "failed to reduce B: oh", (<-errChan).Error())
+	Collect(out)
+	ut.AssertEqual(t, 0, cacheStats(t, cache).Entries)
+}
+
+func TestHashValues(t *testing.T) {
+	a, err := hashValues([]interface{}{1, "a", nil})
+	ut.AssertEqual(t, nil, err)
+	b, err := hashValues([]interface{}{nil, "a", 1})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, a, b)
+	c, err := hashValues([]interface{}{int64(1), "a", nil})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, false, a == c)
+}
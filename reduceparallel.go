@@ -0,0 +1,104 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// reduceParallel is reduce with Options.ReduceParallelismPerKey. It splits
+// the values of io across partial reducers, then reduces their outputs.
+func (j *job) reduceParallel(io *reduceIO) {
+	n := j.opts.ReduceParallelismPerKey
+	shared := make(chan interface{})
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var partials []*reduceIO
+	failed := false
+	// start starts a partial reducer with first as its first value, so a
+	// partial reducer never receives an empty ReduceValues(), then the values
+	// it picks up from shared.
+	start := func(first interface{}) {
+		p := j.newReduceIO(io.reduceKey, nil)
+		p.record = true
+		p.partial = true
+		partials = append(partials, p)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			defer close(p.reducerInput)
+			for v := first; ; {
+				atomic.AddInt64(&p.numValues, 1)
+				select {
+				case p.reducerInput <- v:
+				case <-j.ctx.Done():
+					return
+				}
+				var ok bool
+				if v, ok = <-shared; !ok {
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			err := j.callReduce(p)
+			if err != nil {
+				j.reportError(&ReduceError{io.reduceKey, err})
+				lock.Lock()
+				failed = true
+				lock.Unlock()
+			}
+			for range p.reducerInput {
+			}
+		}()
+	}
+	for v := range io.reducerInput {
+		if len(partials) < n {
+			// Start another partial reducer only when the ones running are all
+			// busy.
+			select {
+			case shared <- v:
+			default:
+				start(v)
+			}
+			continue
+		}
+		select {
+		case shared <- v:
+		case <-j.ctx.Done():
+		}
+	}
+	close(shared)
+	wg.Wait()
+	if failed {
+		return
+	}
+
+	// Reduce the outputs of the partial reducers.
+	var values []interface{}
+	for _, p := range partials {
+		for _, kv := range p.recorded {
+			values = append(values, kv.Value)
+		}
+	}
+	if len(values) == 0 {
+		return
+	}
+	final := j.newReduceIO(io.reduceKey, io.reducerOutput)
+	final.numValues = int64(len(values))
+	go func() {
+		defer close(final.reducerInput)
+		for _, v := range values {
+			select {
+			case final.reducerInput <- v:
+			case <-j.ctx.Done():
+				return
+			}
+		}
+	}()
+	j.reduce(final)
+}
@@ -0,0 +1,54 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+// mapperHot emits the values 1 to 1000 to the single reduce key "hot".
+type mapperHot struct {
+}
+
+func (m *mapperHot) Map(io MapIO) error {
+	for i := 1; i <= 1000; i++ {
+		io.Emit("hot", i)
+	}
+	return nil
+}
+
+// reducerSumCounted is ReduceSum that counts its calls.
+type reducerSumCounted struct {
+	lock  sync.Mutex
+	calls int
+}
+
+func (r *reducerSumCounted) Reduce(io ReduceIO) error {
+	r.lock.Lock()
+	r.calls++
+	r.lock.Unlock()
+	return (&ReduceSum{}).Reduce(io)
+}
+
+func TestMapReduceReduceParallelismPerKey(t *testing.T) {
+	reducer := &reducerSumCounted{}
+	out := make(chan KeyValue, 1)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A", "B"}), out, nil, nil, nil, &mapperHot{}, reducer, &Options{ReduceParallelismPerKey: 4})
+	ut.AssertEqual(t, []KeyValue{{"hot", 2 * 500500}}, Collect(out))
+	// At least one partial reducer and the final reducer.
+	ut.AssertEqual(t, true, reducer.calls >= 2 && reducer.calls <= 5)
+}
+
+func TestMapReduceReduceParallelismPerKeyError(t *testing.T) {
+	errChan := make(chan error, 4)
+	out := make(chan KeyValue, 1)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A"}), out, errChan, nil, nil, mapperValues{"A": {1, "a"}}, &ReduceSum{}, &Options{ReduceParallelismPerKey: 2})
+	// The final reducer doesn't run once a partial reducer failed.
+	ut.AssertEqual(t, 0, len(Collect(out)))
+	ut.AssertEqual(t, true, len(errChan) >= 1)
+}
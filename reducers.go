@@ -0,0 +1,215 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import (
+	"container/heap"
+	"fmt"
+)
+
+// ReducerFunc adapts an ordinary function into a Reducer.
+type ReducerFunc func(io ReduceIO) error
+
+// Reduce implements Reducer by calling f(io).
+func (f ReducerFunc) Reduce(io ReduceIO) error {
+	return f(io)
+}
+
+// FoldReducer is an alternative to Reducer for aggregations that fold the
+// values one at a time into an accumulator, without buffering them. Use
+// ReducerFromFold to pass it to MapReduce.
+type FoldReducer interface {
+	// Init returns the initial accumulator of a reduce key.
+	Init() interface{}
+	// Fold returns the accumulator updated with value.
+	Fold(acc, value interface{}) interface{}
+	// Finalize returns the output for key once all its values were folded.
+	Finalize(key string, acc interface{}) KeyValue
+}
+
+// ReducerFromFold adapts a FoldReducer into a Reducer. It calls Fold for each
+// value as it is received and outputs the result of Finalize once all the
+// values were received. Nothing is output if the run is cancelled meanwhile.
+func ReducerFromFold(f FoldReducer) Reducer {
+	return &foldReducer{f}
+}
+
+type foldReducer struct {
+	f FoldReducer
+}
+
+func (r *foldReducer) Reduce(io ReduceIO) error {
+	acc := r.f.Init()
+	for v := range io.ReduceValues() {
+		acc = r.f.Fold(acc, v)
+	}
+	if io.Cancelled() {
+		return nil
+	}
+	kv := r.f.Finalize(io.ReduceKey(), acc)
+	io.Output(kv.Key, kv.Value)
+	return nil
+}
+
+// ReducePassThrough passes the values mapped directly as-is.
+type ReducePassThrough struct {
+}
+
+// Reduce implements Reducer.
+func (r *ReducePassThrough) Reduce(io ReduceIO) error {
+	key := io.ReduceKey()
+	for i := range io.ReduceValues() {
+		io.Output(key, i)
+	}
+	return nil
+}
+
+// ReduceCount outputs the number of values received for each reduce key, as
+// an int.
+type ReduceCount struct {
+}
+
+// Reduce implements Reducer.
+func (r *ReduceCount) Reduce(io ReduceIO) error {
+	count := 0
+	for range io.ReduceValues() {
+		count++
+	}
+	io.Output(io.ReduceKey(), count)
+	return nil
+}
+
+// ReduceSum outputs the sum of the values received for each reduce key.
+//
+// The values must all be of the same type, one of int, int64 or float64. The
+// sum is output with that type.
+type ReduceSum struct {
+}
+
+// Reduce implements Reducer.
+func (r *ReduceSum) Reduce(io ReduceIO) error {
+	var sum interface{}
+	for v := range io.ReduceValues() {
+		var err error
+		if sum, err = addNumbers(sum, v); err != nil {
+			return err
+		}
+	}
+	io.Output(io.ReduceKey(), sum)
+	return nil
+}
+
+// CombineSum is the Combiner counterpart of ReduceSum. It sums the values
+// emitted by a mapper call per reduce key.
+type CombineSum struct {
+}
+
+// Combine implements Combiner.
+func (c *CombineSum) Combine(reduceKey string, values []interface{}) (interface{}, error) {
+	var sum interface{}
+	for _, v := range values {
+		var err error
+		if sum, err = addNumbers(sum, v); err != nil {
+			return nil, err
+		}
+	}
+	return sum, nil
+}
+
+// Sum returns a Combiner and a Reducer that sum numeric values per reduce key,
+// e.g. for word counting. Set the Combiner as Options.Combiner.
+func Sum() (Combiner, Reducer) {
+	return &CombineSum{}, &ReduceSum{}
+}
+
+// addNumbers returns a+b. a may be nil.
+func addNumbers(a, b interface{}) (interface{}, error) {
+	switch y := b.(type) {
+	case int:
+		if a == nil {
+			return y, nil
+		}
+		if x, ok := a.(int); ok {
+			return x + y, nil
+		}
+	case int64:
+		if a == nil {
+			return y, nil
+		}
+		if x, ok := a.(int64); ok {
+			return x + y, nil
+		}
+	case float64:
+		if a == nil {
+			return y, nil
+		}
+		if x, ok := a.(float64); ok {
+			return x + y, nil
+		}
+	default:
+		return nil, fmt.Errorf("can't sum type %T", b)
+	}
+	return nil, fmt.Errorf("can't sum %T with %T", a, b)
+}
+
+// ReduceTopN outputs the N largest values received for each reduce key,
+// largest first, as determined by Less. Fewer than N values are output when
+// fewer were received.
+type ReduceTopN struct {
+	N    int
+	Less func(a, b interface{}) bool
+}
+
+// Reduce implements Reducer.
+func (r *ReduceTopN) Reduce(io ReduceIO) error {
+	if r.N <= 0 {
+		return fmt.Errorf("invalid N %d", r.N)
+	}
+	// h is a min-heap so the smallest of the top values is the one evicted.
+	h := &valueHeap{less: r.Less}
+	for v := range io.ReduceValues() {
+		if h.Len() < r.N {
+			heap.Push(h, v)
+		} else if r.Less(h.values[0], v) {
+			h.values[0] = v
+			heap.Fix(h, 0)
+		}
+	}
+	top := make([]interface{}, h.Len())
+	for i := len(top) - 1; i >= 0; i-- {
+		top[i] = heap.Pop(h)
+	}
+	for _, v := range top {
+		io.Output(io.ReduceKey(), v)
+	}
+	return nil
+}
+
+type valueHeap struct {
+	values []interface{}
+	less   func(a, b interface{}) bool
+}
+
+func (h *valueHeap) Len() int {
+	return len(h.values)
+}
+
+func (h *valueHeap) Less(i, j int) bool {
+	return h.less(h.values[i], h.values[j])
+}
+
+func (h *valueHeap) Swap(i, j int) {
+	h.values[i], h.values[j] = h.values[j], h.values[i]
+}
+
+func (h *valueHeap) Push(x interface{}) {
+	h.values = append(h.values, x)
+}
+
+func (h *valueHeap) Pop() interface{} {
+	x := h.values[len(h.values)-1]
+	h.values = h.values[:len(h.values)-1]
+	return x
+}
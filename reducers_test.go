@@ -0,0 +1,165 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+// mapperValues emits the values in its map to the reduce key of the map key.
+type mapperValues map[string][]interface{}
+
+func (m mapperValues) Map(io MapIO) error {
+	for _, v := range m[io.MapKey()] {
+		io.Emit("k", v)
+	}
+	return nil
+}
+
+func runValues(t *testing.T, values []interface{}, reducer Reducer) ([]KeyValue, []error) {
+	return RunInMemory([]string{"A"}, mapperValues{"A": values}, reducer)
+}
+
+func TestReduceCount(t *testing.T) {
+	results, errs := runValues(t, []interface{}{1, "a", 2.}, &ReduceCount{})
+	ut.AssertEqual(t, 0, len(errs))
+	ut.AssertEqual(t, []KeyValue{{"k", 3}}, results)
+}
+
+func TestReduceSum(t *testing.T) {
+	data := []struct {
+		values   []interface{}
+		expected interface{}
+	}{
+		{[]interface{}{1, 2, 3}, 6},
+		{[]interface{}{int64(1), int64(2)}, int64(3)},
+		{[]interface{}{1.5, 2.}, 3.5},
+	}
+	for i, line := range data {
+		results, errs := runValues(t, line.values, &ReduceSum{})
+		ut.AssertEqualIndex(t, i, 0, len(errs))
+		ut.AssertEqualIndex(t, i, []KeyValue{{"k", line.expected}}, results)
+	}
+}
+
+func TestReduceSumError(t *testing.T) {
+	results, errs := runValues(t, []interface{}{"a"}, &ReduceSum{})
+	ut.AssertEqual(t, 0, len(results))
+	ut.AssertEqual(t, 1, len(errs))
+	ut.AssertEqual(t, "failed to reduce k: can't sum type string", errs[0].Error())
+
+	// The order of the values is not deterministic so the error message isn't
+	// either.
+	results, errs = runValues(t, []interface{}{1, 1, 1, int64(1)}, &ReduceSum{})
+	ut.AssertEqual(t, 0, len(results))
+	ut.AssertEqual(t, 1, len(errs))
+	ut.AssertEqual(t, true, strings.HasPrefix(errs[0].Error(), "failed to reduce k: can't sum "))
+}
+
+func TestReduceTopN(t *testing.T) {
+	// Sort by string length.
+	less := func(a, b interface{}) bool {
+		return len(a.(string)) < len(b.(string))
+	}
+	values := []interface{}{"aa", "a", "aaaaa", "aaa", "aaaa"}
+	data := []struct {
+		n        int
+		expected []KeyValue
+	}{
+		{1, []KeyValue{{"k", "aaaaa"}}},
+		{3, []KeyValue{{"k", "aaaaa"}, {"k", "aaaa"}, {"k", "aaa"}}},
+		{10, []KeyValue{{"k", "aaaaa"}, {"k", "aaaa"}, {"k", "aaa"}, {"k", "aa"}, {"k", "a"}}},
+	}
+	for i, line := range data {
+		results, errs := RunInMemory([]string{"A"}, mapperValues{"A": values}, &ReduceTopN{N: line.n, Less: less})
+		ut.AssertEqualIndex(t, i, 0, len(errs))
+		ut.AssertEqualIndex(t, i, line.expected, results)
+	}
+}
+
+func TestReduceTopNInvalid(t *testing.T) {
+	results, errs := runValues(t, []interface{}{1}, &ReduceTopN{})
+	ut.AssertEqual(t, 0, len(results))
+	ut.AssertEqual(t, 1, len(errs))
+	ut.AssertEqual(t, "failed to reduce k: invalid N 0", errs[0].Error())
+}
+
+func TestReducerFunc(t *testing.T) {
+	var keys []string
+	reducer := ReducerFunc(func(io ReduceIO) error {
+		keys = append(keys, io.ReduceKey())
+		for v := range io.ReduceValues() {
+			io.Output(io.ReduceKey(), v)
+		}
+		return nil
+	})
+	results, errs := runValues(t, []interface{}{1}, reducer)
+	ut.AssertEqual(t, []KeyValue{{"k", 1}}, results)
+	ut.AssertEqual(t, 0, len(errs))
+	ut.AssertEqual(t, []string{"k"}, keys)
+}
+
+// mapperWords emits (word, 1) for each word of the map key.
+type mapperWords struct {
+}
+
+func (m *mapperWords) Map(io MapIO) error {
+	for _, w := range strings.Fields(io.MapKey()) {
+		io.Emit(w, 1)
+	}
+	return nil
+}
+
+func TestSum(t *testing.T) {
+	combiner, reducer := Sum()
+	cache := &MappingCache{}
+	cache.SetValueType(0)
+	out := make(chan KeyValue, 3)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"a b a", "b c a"}), out, nil, cache, nil, &mapperWords{}, reducer, &Options{Combiner: combiner})
+	ut.AssertEqual(t, map[string]interface{}{"a": 3, "b": 2, "c": 1}, collectMap(out))
+	// The combined values are cached.
+	kvs, _, _ := cache.GetKey("a b a")
+	ut.AssertEqual(t, []KeyValue{{"a", 2}, {"b", 1}}, kvs)
+}
+
+func TestCombineSumError(t *testing.T) {
+	errChan := make(chan error, 1)
+	mapper := mapperValues{"A": {1, "a"}}
+	out := make(chan KeyValue, 1)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"A"}), out, errChan, nil, nil, mapper, &ReduceSum{}, &Options{Combiner: &CombineSum{}})
+	ut.AssertEqual(t, "failed to map A: failed to combine k: can't sum type string", (<-errChan).Error())
+	ut.AssertEqual(t, 0, len(Collect(out)))
+}
+
+// foldMean computes the mean of int values.
+type foldMean struct {
+}
+
+type meanAcc struct {
+	sum, count int
+}
+
+func (f *foldMean) Init() interface{} {
+	return meanAcc{}
+}
+
+func (f *foldMean) Fold(acc, value interface{}) interface{} {
+	a := acc.(meanAcc)
+	return meanAcc{a.sum + value.(int), a.count + 1}
+}
+
+func (f *foldMean) Finalize(key string, acc interface{}) KeyValue {
+	a := acc.(meanAcc)
+	return KeyValue{"mean " + key, float64(a.sum) / float64(a.count)}
+}
+
+func TestReducerFromFold(t *testing.T) {
+	results, errs := runValues(t, []interface{}{1, 2, 3, 6}, ReducerFromFold(&foldMean{}))
+	ut.AssertEqual(t, 0, len(errs))
+	ut.AssertEqual(t, []KeyValue{{"mean k", 3.}}, results)
+}
@@ -0,0 +1,114 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import (
+	"sort"
+	"sync"
+)
+
+// runReducePipeline is runReduce followed by Options.ReduceStages, if any.
+func (j *job) runReducePipeline(accumulator <-chan KeyValue, out chan<- KeyValue) {
+	if len(j.opts.ReduceStages) == 0 {
+		j.runReduce(accumulator, out)
+		return
+	}
+	var wg sync.WaitGroup
+	in := make(chan KeyValue)
+	wg.Add(1)
+	go func(out chan<- KeyValue) {
+		defer wg.Done()
+		defer close(out)
+		j.runReduce(accumulator, out)
+	}(in)
+	for i := range j.opts.ReduceStages {
+		stage := i + 1
+		stageOut := out
+		var next chan KeyValue
+		if stage != len(j.opts.ReduceStages) {
+			next = make(chan KeyValue)
+			stageOut = next
+		}
+		wg.Add(1)
+		go func(in <-chan KeyValue) {
+			defer wg.Done()
+			if next != nil {
+				defer close(next)
+			}
+			j.runReduceStage(stage, in, stageOut)
+		}(in)
+		in = next
+	}
+	wg.Wait()
+}
+
+// runReduceStage groups the outputs of the previous stage read from in by
+// final key, then runs the reducer of Options.ReduceStages[stage-1] for each
+// of them, concurrently unless with Options.SerialReduce or
+// Options.Deterministic.
+func (j *job) runReduceStage(stage int, in <-chan KeyValue, out chan<- KeyValue) {
+	groups := map[string][]interface{}{}
+	for {
+		var kv KeyValue
+		ok := false
+		select {
+		case kv, ok = <-in:
+		case <-j.ctx.Done():
+		}
+		if !ok {
+			break
+		}
+		groups[kv.Key] = append(groups[kv.Key], kv.Value)
+	}
+	if j.ctx.Err() != nil {
+		return
+	}
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if j.opts.SerialReduce || j.opts.Deterministic {
+		for _, k := range keys {
+			if j.ctx.Err() != nil {
+				return
+			}
+			j.reduceStageKey(stage, k, groups[k], out)
+		}
+		return
+	}
+	var wg sync.WaitGroup
+	for _, k := range keys {
+		wg.Add(1)
+		go func(k string, values []interface{}) {
+			defer wg.Done()
+			if !j.acquireReducer() {
+				return
+			}
+			defer j.releaseReducer()
+			j.reduceStageKey(stage, k, values, out)
+		}(k, groups[k])
+	}
+	wg.Wait()
+}
+
+// reduceStageKey runs the reducer of Options.ReduceStages[stage-1] for the
+// final key k of the previous stage over its values.
+func (j *job) reduceStageKey(stage int, k string, values []interface{}, out chan<- KeyValue) {
+	r := j.newReduceIO(k, out)
+	r.stage = stage
+	r.numValues = int64(len(values))
+	go func() {
+		defer close(r.reducerInput)
+		for _, v := range values {
+			select {
+			case r.reducerInput <- v:
+			case <-j.ctx.Done():
+				return
+			}
+		}
+	}()
+	j.reduce(r)
+}
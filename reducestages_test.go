@@ -0,0 +1,45 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import (
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func TestMapReduceReduceStages(t *testing.T) {
+	// Count the words, then regroup all the counts under a single key, then
+	// sum them.
+	regroup := ReducerFunc(func(io ReduceIO) error {
+		for v := range io.ReduceValues() {
+			io.Output("total", v)
+		}
+		return nil
+	})
+	perf := &PerfStats{}
+	out := make(chan KeyValue, 4)
+	opts := &Options{ReduceStages: []Reducer{regroup, &ReduceSum{}}, DetectDuplicateOutput: true}
+	errChan := make(chan error, 4)
+	MapReduceWithOptions(GeneratorFromSlice([]string{"a b a", "b c a"}), out, errChan, nil, perf, &mapperWords{}, &ReduceSum{}, opts)
+	ut.AssertEqual(t, []KeyValue{{"total", 6}}, Collect(out))
+	// The output options only apply to the last stage.
+	ut.AssertEqual(t, 0, len(errChan))
+	ut.AssertEqual(t, 0, perf.ReducersRunning())
+}
+
+func TestMapReduceReduceStagesSerial(t *testing.T) {
+	// The stage runs one reducer at a time, in final key order.
+	perf := &PerfStats{}
+	stage := &reducerRecord{perf: perf}
+	for _, opts := range []*Options{{SerialReduce: true}, {Deterministic: true}} {
+		stage.max = 0
+		opts.ReduceStages = []Reducer{stage}
+		out := make(chan KeyValue, 3)
+		MapReduceWithOptions(GeneratorFromSlice([]string{"c b a", "a b c"}), out, nil, nil, perf, &mapperWords{}, &ReduceSum{}, opts)
+		ut.AssertEqual(t, []KeyValue{{"a", 1}, {"b", 1}, {"c", 1}}, Collect(out))
+		ut.AssertEqual(t, 1, stage.max)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import (
+	"container/heap"
+)
+
+// PrioritizedKey is a map key with a scheduling priority. Keys with a higher
+// Priority are started first. See MapReducePrioritized.
+type PrioritizedKey struct {
+	Key      string
+	Priority int
+}
+
+// pendingPerSlot is the number of keys read ahead from the generator per
+// mapper slot, to pick the highest priority one when a slot frees up.
+const pendingPerSlot = 16
+
+// schedule reads keys from generator and calls start for each of them.
+//
+// When slots is not nil, a slot is acquired before each call to start, highest
+// priority first, and the callee must release it once the key is processed.
+// Up to pendingPerSlot keys per slot are read ahead from generator.
+func (j *job) schedule(generator <-chan PrioritizedKey, slots chan struct{}, start func(key string)) {
+	if slots == nil {
+		for {
+			select {
+			case k, ok := <-generator:
+				if !ok {
+					return
+				}
+				start(k.Key)
+			case <-j.ctx.Done():
+				return
+			}
+		}
+	}
+
+	pending := &keyHeap{}
+	seq := 0
+	for generator != nil || pending.Len() != 0 {
+		// Only try to acquire a slot when there is a key to start and only read
+		// more keys when there is room for them.
+		var acquire chan<- struct{}
+		if pending.Len() != 0 {
+			acquire = slots
+		}
+		var read <-chan PrioritizedKey
+		if pending.Len() < pendingPerSlot*cap(slots) {
+			read = generator
+		}
+		select {
+		case k, ok := <-read:
+			if !ok {
+				generator = nil
+				continue
+			}
+			heap.Push(pending, scheduledKey{k, seq})
+			seq++
+		case acquire <- struct{}{}:
+			start(heap.Pop(pending).(scheduledKey).Key)
+		case <-j.ctx.Done():
+			return
+		}
+	}
+}
+
+type scheduledKey struct {
+	PrioritizedKey
+	seq int // Generator order, to break ties.
+}
+
+// keyHeap is a heap of scheduledKey with the highest priority on top.
+type keyHeap []scheduledKey
+
+func (h keyHeap) Len() int {
+	return len(h)
+}
+
+func (h keyHeap) Less(i, j int) bool {
+	if h[i].Priority != h[j].Priority {
+		return h[i].Priority > h[j].Priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h keyHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *keyHeap) Push(x interface{}) {
+	*h = append(*h, x.(scheduledKey))
+}
+
+func (h *keyHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,130 @@
+// Copyright 2014 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package mapreduce
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maruel/ut"
+)
+
+// mapperRecord records the order in which the keys are mapped. The mapping of
+// the first key blocks until release is closed.
+type mapperRecord struct {
+	release chan struct{}
+	lock    sync.Mutex
+	keys    []string
+	running int
+	max     int
+}
+
+func (m *mapperRecord) Map(io MapIO) error {
+	m.lock.Lock()
+	m.keys = append(m.keys, io.MapKey())
+	first := len(m.keys) == 1
+	m.running++
+	if m.running > m.max {
+		m.max = m.running
+	}
+	m.lock.Unlock()
+	if first {
+		<-m.release
+	}
+	m.lock.Lock()
+	m.running--
+	m.lock.Unlock()
+	return nil
+}
+
+func TestMapReducePrioritized(t *testing.T) {
+	in := make(chan PrioritizedKey)
+	mapper := &mapperRecord{release: make(chan struct{})}
+	go func() {
+		// The first key occupies the only mapper slot until all the other keys
+		// were read, so they are started by priority.
+		for _, k := range []PrioritizedKey{{"first", 10}, {"low", 1}, {"high", 5}, {"low2", 1}, {"mid", 3}} {
+			in <- k
+		}
+		close(in)
+		close(mapper.release)
+	}()
+	err := MapReducePrioritized(context.Background(), in, make(chan KeyValue), nil, nil, nil, mapper, &ReducePassThrough{}, &Options{MaxMappers: 1})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{"first", "high", "mid", "low", "low2"}, mapper.keys)
+	ut.AssertEqual(t, 1, mapper.max)
+}
+
+func TestMapReduceMaxMappers(t *testing.T) {
+	mapper := &mapperRecord{release: make(chan struct{})}
+	close(mapper.release)
+	keys := []string{"A", "B", "C", "D", "E", "F", "G", "H"}
+	MapReduceWithOptions(GeneratorFromSlice(keys), make(chan KeyValue), nil, nil, nil, mapper, &ReducePassThrough{}, &Options{MaxMappers: 2})
+	ut.AssertEqual(t, len(keys), len(mapper.keys))
+	ut.AssertEqual(t, true, mapper.max <= 2)
+}
+
+func TestMapReduceMaxMappersReadAhead(t *testing.T) {
+	mapper := &mapperRecord{release: make(chan struct{})}
+	in := make(chan string)
+	read := 0
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		MapReduceWithOptions(in, make(chan KeyValue), nil, nil, nil, mapper, &ReducePassThrough{}, &Options{MaxMappers: 1})
+	}()
+	// The first key blocks the only mapper slot, so only pendingPerSlot more
+	// keys are read, plus one held by MapReduceContext for the scheduler.
+	for ; read < pendingPerSlot+2; read++ {
+		in <- "k"
+	}
+	select {
+	case in <- "k":
+		t.Fatal("read past the pending keys limit")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(mapper.release)
+	close(in)
+	<-done
+	ut.AssertEqual(t, read, len(mapper.keys))
+}
+
+// reducerRecord records the maximum number of reducers running concurrently,
+// as seen by PerfStats.
+type reducerRecord struct {
+	perf *PerfStats
+	lock sync.Mutex
+	max  int
+}
+
+func (r *reducerRecord) Reduce(io ReduceIO) error {
+	count := 0
+	for range io.ReduceValues() {
+		count++
+	}
+	r.lock.Lock()
+	if n := r.perf.ReducersRunning(); n > r.max {
+		r.max = n
+	}
+	r.lock.Unlock()
+	io.Output(io.ReduceKey(), count)
+	return nil
+}
+
+func TestMapReduceMaxReducers(t *testing.T) {
+	perf := &PerfStats{}
+	reducer := &reducerRecord{perf: perf}
+	keys := []string{"a b c d", "e f g h", "a b c d e f g h"}
+	out := make(chan KeyValue, 8)
+	// MaxBufferedValues is ignored; it would otherwise deadlock on the values
+	// of the reduce keys waiting for a reducer.
+	MapReduceWithOptions(GeneratorFromSlice(keys), out, nil, nil, perf, &mapperWords{}, reducer, &Options{MaxReducers: 2, MaxBufferedValues: 1})
+	expected := map[string]interface{}{"a": 2, "b": 2, "c": 2, "d": 2, "e": 2, "f": 2, "g": 2, "h": 2}
+	ut.AssertEqual(t, expected, collectMap(out))
+	ut.AssertEqual(t, true, reducer.max > 0 && reducer.max <= 2)
+	ut.AssertEqual(t, 0, perf.ReducersRunning())
+}